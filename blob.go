@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/cli/go-gh/pkg/api"
+)
+
+// rawClient is a REST client that requests the raw media type, so that blobs
+// are returned as their exact contents instead of as base64 encoded JSON.
+var rawClient api.RESTClient
+
+// blobChunkSize is the size of the chunks that blob contents are read from
+// the network in.
+const blobChunkSize = 64 * 1024
+
+// blobPath returns the REST api path of the blob with the given oid in r.
+func blobPath(r *Repo, oid string) string {
+	return fmt.Sprintf("repos/%s/%s/git/blobs/%s", url.PathEscape(r.Owner.Login),
+		url.PathEscape(r.Name), url.PathEscape(oid))
+}
+
+// blobStream implements fs.HandleReader and fs.HandleReleaser for a blob whose
+// exact contents are fetched through the REST api. Unlike Blob.text in the
+// GraphQL api, this works for binary and large blobs. The contents are
+// downloaded in the background in chunks, so reads near the start of the blob
+// can be answered before the whole blob has arrived.
+type blobStream struct {
+	// cancel stops the background download.
+	cancel context.CancelFunc
+
+	mu sync.Mutex
+	// data is the portion of the blob that has been downloaded so far.
+	data []byte
+	// done is true once the download has finished, successfully or not.
+	done bool
+	// err is the error that stopped the download, if any.
+	err error
+	// progress is closed and replaced each time more data arrives, so readers
+	// can wait for it without ignoring their request's cancellation.
+	progress chan struct{}
+}
+
+// newBlobStream starts downloading the blob with the given oid and size in r.
+func newBlobStream(r *Repo, oid string, size int) *blobStream {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &blobStream{
+		cancel:   cancel,
+		data:     make([]byte, 0, size),
+		progress: make(chan struct{}),
+	}
+	go s.fetch(ctx, r, oid)
+	return s
+}
+
+func (s *blobStream) fetch(ctx context.Context, r *Repo, oid string) {
+	resp, err := rawClient.RequestWithContext(ctx, http.MethodGet,
+		blobPath(r, oid), nil)
+	if err == nil {
+		defer resp.Body.Close()
+
+		buf := make([]byte, blobChunkSize)
+		for err == nil {
+			var n int
+			n, err = resp.Body.Read(buf)
+
+			s.mu.Lock()
+			s.data = append(s.data, buf[:n]...)
+			close(s.progress)
+			s.progress = make(chan struct{})
+			s.mu.Unlock()
+		}
+		if err == io.EOF {
+			err = nil
+			objects.put(blobsKind, oid, s.data)
+		}
+	}
+	if err != nil && ctx.Err() == nil {
+		log.Printf("%s: %v", blobPath(r, oid), err)
+	}
+
+	s.mu.Lock()
+	s.done = true
+	s.err = errno(err)
+	close(s.progress)
+	s.mu.Unlock()
+}
+
+func (s *blobStream) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	end := req.Offset + int64(req.Size)
+
+	s.mu.Lock()
+	for !s.done && int64(len(s.data)) < end {
+		progress := s.progress
+		s.mu.Unlock()
+
+		select {
+		case <-progress:
+		case <-ctx.Done():
+			return syscall.EINTR
+		}
+
+		s.mu.Lock()
+	}
+	defer s.mu.Unlock()
+
+	if int64(len(s.data)) < end && s.err != nil {
+		return s.err
+	}
+
+	if req.Offset < int64(len(s.data)) {
+		if end > int64(len(s.data)) {
+			end = int64(len(s.data))
+		}
+		resp.Data = append(resp.Data[:0], s.data[req.Offset:end]...)
+	}
+	return nil
+}
+
+// readAll waits for the whole blob to be downloaded, and returns its contents,
+// which must not be modified.
+func (s *blobStream) readAll(ctx context.Context) ([]byte, error) {
+	s.mu.Lock()
+	for !s.done {
+		progress := s.progress
+		s.mu.Unlock()
+
+		select {
+		case <-progress:
+		case <-ctx.Done():
+			return nil, syscall.EINTR
+		}
+
+		s.mu.Lock()
+	}
+	defer s.mu.Unlock()
+
+	return s.data, s.err
+}
+
+func (s *blobStream) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	s.cancel()
+	return nil
+}
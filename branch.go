@@ -0,0 +1,1242 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	graphql "github.com/cli/shurcooL-graphql"
+)
+
+// commitFileName is the name of the control file within each writable branch
+// directory that commits the branch's staged changes when written to, using
+// what was written as the commit message.
+const commitFileName = ".commit"
+
+// discardFileName is the name of the control file within each writable branch
+// directory that discards the branch's staged changes when written to.
+const discardFileName = ".discard"
+
+// maxFileSize is the largest that staged files can grow to. Github rejects
+// files larger than 100 MiB, so larger files could never be committed, and
+// there's no point holding them in memory.
+const maxFileSize = 100 << 20
+
+// branchBaseXattr is the extended attribute that can be set on the .refs/heads
+// directory of a repository, or any directory of branches within it, to choose
+// what new branches are created from. It holds a commit id, or anything else
+// that git can resolve to a commit, such as refs/tags/v1.0.0. New branches are
+// created from the head of the default branch if it isn't set.
+const branchBaseXattr = "user.gh-fs.branch-base"
+
+// branchBases contains the value of branchBaseXattr for each repository it has
+// been set for, keyed by the repository's lowercase owner and name. Values are
+// kept in memory, so they have to be set again after remounting.
+var branchBases = struct {
+	sync.Mutex
+	m map[string]string
+}{m: map[string]string{}}
+
+// overlays contains the overlay of every branch that has been looked up while
+// --writable was provided, keyed by the lowercase owner and name of its
+// repository and the branch's name, so that staged changes outlive the nodes
+// that made them.
+var overlays = struct {
+	sync.Mutex
+	m map[string]*overlay
+}{m: map[string]*overlay{}}
+
+// overlay stages changes to the files within a branch in memory, until they
+// are committed to the branch in a single commit.
+type overlay struct {
+	// repo is the repository that the branch belongs to.
+	repo *Repo
+	// branch is the name of the branch, without the refs/heads/ prefix.
+	branch string
+
+	// commitMu is held while changes are being committed, so that commits are
+	// made one at a time.
+	commitMu sync.Mutex
+
+	mu sync.Mutex
+	// head and tree are the ids of the commit that the changes are based on
+	// and its tree. The branch must still point to head when the changes are
+	// committed, so that pushes made in the meantime aren't overwritten.
+	head, tree string
+	// files contains the contents of files that have been created or
+	// modified, by path.
+	files map[string]*stagedFile
+	// removed contains the paths that have been removed from head, mapped to
+	// whether they are directories. Directories don't have to be deleted by
+	// the commit, since they only exist as long as they contain files.
+	removed map[string]bool
+	// dirs contains the paths of directories that have been created. They
+	// are forgotten once files within them are committed, since they then
+	// exist in head, and disappear when all changes are committed if nothing
+	// has been created within them, since git can't store empty directories.
+	dirs map[string]bool
+}
+
+// stagedFile is the contents of a file that has been created or modified.
+type stagedFile struct {
+	data  []byte
+	mtime time.Time
+	// base is the id of the blob this file had in head, or empty if it didn't
+	// exist there, so that files that haven't actually changed are left out
+	// of commits.
+	base string
+	// executable is whether the file was executable in head.
+	executable bool
+	// gen is incremented whenever data changes, so that changes made while a
+	// commit is in progress aren't discarded once it has been made.
+	gen int
+}
+
+// overlayKey returns the key of the overlay of the branch with the given name
+// in r within overlays.
+func overlayKey(r *Repo, branch string) string {
+	return strings.ToLower(r.Owner.Login+"/"+r.Name) + "\x00" + branch
+}
+
+// branchOverlay returns the overlay of the branch with the given name in r,
+// which currently points to the commit head with the given tree.
+func branchOverlay(r *Repo, branch, head, tree string) *overlay {
+	key := overlayKey(r, branch)
+
+	overlays.Lock()
+	defer overlays.Unlock()
+
+	ov, ok := overlays.m[key]
+	if !ok {
+		ov = &overlay{
+			repo:    r,
+			branch:  branch,
+			files:   map[string]*stagedFile{},
+			removed: map[string]bool{},
+			dirs:    map[string]bool{},
+		}
+		overlays.m[key] = ov
+	}
+
+	// Staged changes stay based on the commit they were made to, but an
+	// overlay without any follows its branch. Files that were staged without
+	// being changed are staged again from the new commit when they're next
+	// used.
+	ov.mu.Lock()
+	if !ov.staged() {
+		ov.files = map[string]*stagedFile{}
+		ov.head, ov.tree = head, tree
+	}
+	ov.mu.Unlock()
+
+	return ov
+}
+
+// staged reports whether ov has any changes to commit. Files that have been
+// staged, such as by being opened for writing, don't count unless their
+// contents have actually changed. ov.mu must be held.
+func (ov *overlay) staged() bool {
+	if len(ov.removed) > 0 {
+		return true
+	}
+	for _, s := range ov.files {
+		if blobOid(s.data) != s.base {
+			return true
+		}
+	}
+	return false
+}
+
+// inode returns the inode number of the node at p within ov's branch.
+func (ov *overlay) inode(p string) uint64 {
+	if p == "" {
+		return refInode(ov.repo, refsPrefixes["heads"]+ov.branch)
+	}
+	return inode(ov.repo.Id, refsPrefixes["heads"]+ov.branch, p)
+}
+
+// base returns the node at p within head, without ov's changes applied.
+func (ov *overlay) base(ctx context.Context, p string) (fs.Node, error) {
+	ov.mu.Lock()
+	var n fs.Node = &Dir{Path: "", Rev: ov.head, Oid: ov.tree,
+		Via: refsPrefixes["heads"] + ov.branch, repo: ov.repo}
+	ov.mu.Unlock()
+
+	if p == "" {
+		return n, nil
+	}
+
+	for _, name := range strings.Split(p, "/") {
+		d, ok := n.(*Dir)
+		if !ok {
+			return nil, syscall.ENOENT
+		}
+
+		entries, err := d.entries(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		n = nil
+		for _, entry := range entries {
+			if entry.Name == name {
+				n, err = d.node(ctx, entry)
+				if err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+		if n == nil {
+			return nil, syscall.ENOENT
+		}
+	}
+
+	return n, nil
+}
+
+// inBase reports whether there is anything at p within head.
+func (ov *overlay) inBase(ctx context.Context, p string) (bool, error) {
+	_, err := ov.base(ctx, p)
+	if errors.Is(err, syscall.ENOENT) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// lookup returns the node at p, with ov's changes applied.
+func (ov *overlay) lookup(ctx context.Context, p string) (fs.Node, error) {
+	ov.mu.Lock()
+	_, staged := ov.files[p]
+	_, removed := ov.removed[p]
+	created := ov.dirs[p]
+	ov.mu.Unlock()
+
+	switch {
+	case staged:
+		return &BranchFile{ov: ov, Path: p}, nil
+	case created:
+		return &BranchDir{ov: ov, Path: p}, nil
+	case removed:
+		return nil, syscall.ENOENT
+	}
+
+	n, err := ov.base(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n := n.(type) {
+	case *Dir:
+		// Submodules are directories within other repositories, which can't
+		// be modified
+		if n.repo == ov.repo {
+			return &BranchDir{ov: ov, Path: p}, nil
+		}
+	case *File:
+		return &BranchFile{ov: ov, Path: p}, nil
+	}
+
+	// Symlinks and submodules can be removed, but not modified
+	return n, nil
+}
+
+// list returns the entries of the directory at p, with ov's changes applied.
+func (ov *overlay) list(ctx context.Context, p string) ([]fuse.Dirent, error) {
+	var e []fuse.Dirent
+
+	n, err := ov.base(ctx, p)
+	if err != nil && !errors.Is(err, syscall.ENOENT) {
+		return nil, err
+	}
+	if d, ok := n.(*Dir); ok {
+		entries, err := d.entries(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			// Symlinks and submodules are looked up as they are in head
+			ino := ov.inode(path.Join(p, entry.Name))
+			if entry.Type == "commit" || entry.DirentType() == fuse.DT_Link {
+				ino = entry.inode(d)
+			}
+
+			e = append(e, fuse.Dirent{
+				Inode: ino,
+				Type:  entry.DirentType(),
+				Name:  entry.Name,
+			})
+		}
+	}
+
+	ov.mu.Lock()
+	defer ov.mu.Unlock()
+
+	listed := map[string]bool{}
+	kept := e[:0]
+	for _, d := range e {
+		if _, ok := ov.removed[path.Join(p, d.Name)]; !ok {
+			kept = append(kept, d)
+			listed[d.Name] = true
+		}
+	}
+	e = kept
+
+	add := func(child string, typ fuse.DirentType) {
+		dir, name := path.Split(child)
+		if strings.TrimSuffix(dir, "/") != p || listed[name] {
+			return
+		}
+
+		listed[name] = true
+		e = append(e, fuse.Dirent{Inode: ov.inode(child), Type: typ,
+			Name: name})
+	}
+	for child := range ov.files {
+		add(child, fuse.DT_File)
+	}
+	for child := range ov.dirs {
+		add(child, fuse.DT_Dir)
+	}
+
+	return e, nil
+}
+
+// readFile returns the contents of f.
+func readFile(ctx context.Context, f *File) ([]byte, error) {
+	h, err := f.Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+	if err != nil {
+		return nil, err
+	}
+
+	switch h := h.(type) {
+	case fileData:
+		return h, nil
+	case *blobStream:
+		defer h.cancel()
+		return h.readAll(ctx)
+	}
+	return nil, syscall.EIO
+}
+
+// stage returns the staged contents of the file at p, staging the file's
+// contents in head first if it hasn't been staged yet.
+func (ov *overlay) stage(ctx context.Context, p string) (*stagedFile, error) {
+	ov.mu.Lock()
+	s, ok := ov.files[p]
+	ov.mu.Unlock()
+	if ok {
+		return s, nil
+	}
+
+	n, err := ov.base(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := n.(*File)
+	if !ok {
+		return nil, syscall.EPERM
+	}
+
+	b, err := readFile(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+
+	ov.mu.Lock()
+	defer ov.mu.Unlock()
+
+	// The file may have been staged while its contents were being fetched
+	if s, ok := ov.files[p]; ok {
+		return s, nil
+	}
+
+	s = &stagedFile{
+		data:       append([]byte(nil), b...),
+		mtime:      time.Now(),
+		base:       f.Oid,
+		executable: f.Executable,
+	}
+	ov.files[p] = s
+	return s, nil
+}
+
+// modify stages the file at p, and calls modify with its staged contents
+// while ov.mu is held.
+func (ov *overlay) modify(ctx context.Context, p string, modify func(s *stagedFile)) error {
+	for {
+		s, err := ov.stage(ctx, p)
+		if err != nil {
+			return err
+		}
+
+		ov.mu.Lock()
+		// If the file was committed after it was staged, it has to be
+		// staged again from the new commit
+		if ov.files[p] != s {
+			ov.mu.Unlock()
+			continue
+		}
+
+		modify(s)
+		s.gen++
+		s.mtime = time.Now()
+		ov.mu.Unlock()
+		return nil
+	}
+}
+
+// CreateCommitOnBranchInput is the input of the createCommitOnBranch mutation.
+// Its name is used as the type of the mutation's variable, so it must match
+// the schema.
+type CreateCommitOnBranchInput struct {
+	Branch struct {
+		RepositoryNameWithOwner string `json:"repositoryNameWithOwner"`
+		BranchName              string `json:"branchName"`
+	} `json:"branch"`
+	ExpectedHeadOid string        `json:"expectedHeadOid"`
+	Message         commitMessage `json:"message"`
+	FileChanges     struct {
+		Additions []fileAddition `json:"additions,omitempty"`
+		Deletions []fileDeletion `json:"deletions,omitempty"`
+	} `json:"fileChanges"`
+}
+
+type commitMessage struct {
+	Headline string `json:"headline"`
+	Body     string `json:"body,omitempty"`
+}
+
+type fileAddition struct {
+	Path string `json:"path"`
+	// Contents is encoded as base64, as the mutation expects.
+	Contents []byte `json:"contents"`
+}
+
+type fileDeletion struct {
+	Path string `json:"path"`
+}
+
+// newCommitMessage returns message as a commit message, or a message
+// describing the changes to paths if message is empty.
+func newCommitMessage(message string, paths []string) commitMessage {
+	message = strings.TrimSpace(message)
+	if message != "" {
+		headline, body, _ := strings.Cut(message, "\n")
+		return commitMessage{Headline: headline, Body: strings.TrimSpace(body)}
+	}
+
+	if len(paths) == 1 {
+		return commitMessage{Headline: "Update " + paths[0]}
+	}
+	return commitMessage{
+		Headline: fmt.Sprintf("Update %d files", len(paths)),
+		Body:     "- " + strings.Join(paths, "\n- "),
+	}
+}
+
+// blobOid returns the id that git gives to a blob with the contents b.
+func blobOid(b []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(b))
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// commit commits ov's staged changes to its branch, with the given message,
+// or one describing the changes if it is empty. If only is given, just the
+// changes to those paths are committed, and the rest stay staged. If the
+// branch no longer points to head, nothing is committed, and the changes stay
+// staged.
+func (ov *overlay) commit(ctx context.Context, message string, only ...string) error {
+	ov.commitMu.Lock()
+	defer ov.commitMu.Unlock()
+
+	var input CreateCommitOnBranchInput
+	input.Branch.RepositoryNameWithOwner = ov.repo.Owner.Login + "/" +
+		ov.repo.Name
+	input.Branch.BranchName = ov.branch
+
+	included := func(p string) bool {
+		if len(only) == 0 {
+			return true
+		}
+		for _, o := range only {
+			if p == o {
+				return true
+			}
+		}
+		return false
+	}
+
+	// gens, removed, and dirs record the changes being committed, so that
+	// only those are discarded once the commit has been made. Files whose
+	// contents haven't changed are discarded without being committed.
+	gens := map[string]int{}
+	removed := map[string]bool{}
+	dirs := map[string]bool{}
+	var paths []string
+
+	ov.mu.Lock()
+	input.ExpectedHeadOid = ov.head
+	for p, s := range ov.files {
+		if !included(p) {
+			continue
+		}
+
+		gens[p] = s.gen
+		if blobOid(s.data) == s.base {
+			continue
+		}
+
+		// Empty contents must still be sent as an empty string, rather than
+		// null
+		contents := append([]byte{}, s.data...)
+		input.FileChanges.Additions = append(input.FileChanges.Additions,
+			fileAddition{Path: p, Contents: contents})
+		paths = append(paths, p)
+	}
+	for p, dir := range ov.removed {
+		if !included(p) {
+			continue
+		}
+
+		removed[p] = dir
+		if !dir {
+			input.FileChanges.Deletions = append(input.FileChanges.Deletions,
+				fileDeletion{Path: p})
+			paths = append(paths, p)
+		}
+	}
+	if len(only) == 0 {
+		for p := range ov.dirs {
+			dirs[p] = true
+		}
+	}
+	ov.mu.Unlock()
+
+	if len(paths) == 0 {
+		ov.mu.Lock()
+		ov.forget(gens, removed, nil)
+		ov.mu.Unlock()
+		return nil
+	}
+	sort.Strings(paths)
+	input.Message = newCommitMessage(message, paths)
+
+	var mutation struct {
+		CreateCommitOnBranch struct {
+			Commit struct {
+				Oid  string
+				Tree struct{ Oid string }
+			}
+		} `graphql:"createCommitOnBranch(input: $input)"`
+	}
+	err := runMutation(ctx, "CreateCommitOnBranch", &mutation,
+		map[string]interface{}{"input": input})
+	if err != nil {
+		return err
+	}
+
+	ov.mu.Lock()
+	defer ov.mu.Unlock()
+
+	commit := mutation.CreateCommitOnBranch.Commit
+	ov.head, ov.tree = commit.Oid, commit.Tree.Oid
+	for _, a := range input.FileChanges.Additions {
+		for dir := path.Dir(a.Path); dir != "."; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	ov.forget(gens, removed, dirs)
+	return nil
+}
+
+// forget discards the staged changes to the files whose generations are in
+// gens, and the removals in removed, unless they have changed since, as well
+// as the created directories in dirs that don't contain anything else that's
+// still staged. ov.mu must be held.
+func (ov *overlay) forget(gens map[string]int, removed, dirs map[string]bool) {
+	for p, gen := range gens {
+		if s, ok := ov.files[p]; ok && s.gen == gen {
+			delete(ov.files, p)
+		}
+	}
+	for p, dir := range removed {
+		if d, ok := ov.removed[p]; ok && d == dir {
+			delete(ov.removed, p)
+		}
+	}
+
+	for dir := range dirs {
+		if !ov.dirs[dir] {
+			continue
+		}
+
+		empty := true
+		for p := range ov.files {
+			if strings.HasPrefix(p, dir+"/") {
+				empty = false
+				break
+			}
+		}
+		if empty {
+			delete(ov.dirs, dir)
+		}
+	}
+}
+
+// discard discards ov's staged changes, and bases it on the commit that its
+// branch currently points to. Otherwise, if the branch was pushed to while
+// changes were staged, it could neither be committed to nor deleted.
+func (ov *overlay) discard(ctx context.Context) error {
+	var query struct {
+		Repository struct {
+			Ref *struct {
+				Target refTarget
+			} `graphql:"ref(qualifiedName: $qualifiedName)"`
+		} `graphql:"repository(name: $name, owner: $owner)"`
+	}
+	err := runQuery(ctx, "LookupBranch", &query, map[string]interface{}{
+		"name":          graphql.String(ov.repo.Name),
+		"owner":         graphql.String(ov.repo.Owner.Login),
+		"qualifiedName": graphql.String(refsPrefixes["heads"] + ov.branch),
+	})
+	if err != nil {
+		return err
+	}
+
+	ov.commitMu.Lock()
+	defer ov.commitMu.Unlock()
+	ov.mu.Lock()
+	defer ov.mu.Unlock()
+
+	ov.files = map[string]*stagedFile{}
+	ov.removed = map[string]bool{}
+	ov.dirs = map[string]bool{}
+	// If the branch has been deleted, its directory will disappear once the
+	// kernel looks it up again
+	if query.Repository.Ref != nil {
+		ov.head, ov.tree = query.Repository.Ref.Target.commit()
+	}
+	return nil
+}
+
+// BranchDir implements fs.Node, fs.NodeRequestLookuper, HandleReadDirAller,
+// fs.NodeCreater, fs.NodeMkdirer, fs.NodeRemover, and fs.NodeRenamer for a
+// directory within a branch that was looked up while --writable was provided.
+// Changes made within it are staged in the branch's overlay until they are
+// committed.
+type BranchDir struct {
+	ov *overlay
+	// Path is the path to this directory relative to the root of the
+	// repository.
+	Path string
+}
+
+func (d *BranchDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Valid = cli.RepoTTL
+	a.Inode = d.ov.inode(d.Path)
+	setMode(a, os.ModeDir|0o700)
+	a.Mtime = d.ov.repo.PushedAt
+	a.Ctime = d.ov.repo.UpdatedAt
+	return nil
+}
+
+func (d *BranchDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	resp.EntryValid = cli.RepoTTL
+	if d.Path == "" {
+		switch req.Name {
+		case commitFileName:
+			return &CommitFile{ov: d.ov}, nil
+		case discardFileName:
+			return &DiscardFile{ov: d.ov}, nil
+		}
+	}
+
+	return d.ov.lookup(ctx, path.Join(d.Path, req.Name))
+}
+
+// BranchDir doesn't display the .commit and .discard files, for the same
+// reasons that RepoDir doesn't display the .refresh file.
+func (d *BranchDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return d.ov.list(ctx, d.Path)
+}
+
+func (d *BranchDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	if !fromOwner(req.Header) {
+		return nil, nil, syscall.EACCES
+	}
+
+	p := path.Join(d.Path, req.Name)
+
+	d.ov.mu.Lock()
+	d.ov.files[p] = &stagedFile{mtime: time.Now()}
+	delete(d.ov.removed, p)
+	d.ov.mu.Unlock()
+
+	f := &BranchFile{ov: d.ov, Path: p}
+	return f, &branchHandle{f: f}, nil
+}
+
+func (d *BranchDir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	if !fromOwner(req.Header) {
+		return nil, syscall.EACCES
+	}
+
+	p := path.Join(d.Path, req.Name)
+
+	d.ov.mu.Lock()
+	d.ov.dirs[p] = true
+	delete(d.ov.removed, p)
+	d.ov.mu.Unlock()
+
+	return &BranchDir{ov: d.ov, Path: p}, nil
+}
+
+func (d *BranchDir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if !fromOwner(req.Header) {
+		return syscall.EACCES
+	}
+
+	p := path.Join(d.Path, req.Name)
+
+	n, err := d.ov.lookup(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	_, isDir := n.(*BranchDir)
+	if req.Dir && !isDir {
+		return syscall.ENOTDIR
+	} else if !req.Dir && isDir {
+		return syscall.EISDIR
+	}
+
+	if isDir {
+		e, err := d.ov.list(ctx, p)
+		if err != nil {
+			return err
+		}
+		if len(e) > 0 {
+			return syscall.ENOTEMPTY
+		}
+	}
+
+	inBase, err := d.ov.inBase(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	d.ov.mu.Lock()
+	defer d.ov.mu.Unlock()
+
+	delete(d.ov.files, p)
+	delete(d.ov.dirs, p)
+	if inBase {
+		d.ov.removed[p] = isDir
+	}
+	return nil
+}
+
+// Rename only supports renaming files within the same branch. Directories
+// can't be renamed without staging everything within them, so EXDEV is
+// returned for them, which makes programs like mv copy them instead.
+func (d *BranchDir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	if !fromOwner(req.Header) {
+		return syscall.EACCES
+	}
+
+	nd, ok := newDir.(*BranchDir)
+	if !ok || nd.ov != d.ov {
+		return syscall.EXDEV
+	}
+	from := path.Join(d.Path, req.OldName)
+	to := path.Join(nd.Path, req.NewName)
+
+	n, err := d.ov.lookup(ctx, from)
+	if err != nil {
+		return err
+	}
+	if _, ok := n.(*BranchFile); !ok {
+		return syscall.EXDEV
+	}
+
+	s, err := d.ov.stage(ctx, from)
+	if err != nil {
+		return err
+	}
+	inBase, err := d.ov.inBase(ctx, from)
+	if err != nil {
+		return err
+	}
+
+	d.ov.mu.Lock()
+	defer d.ov.mu.Unlock()
+
+	// The file is always committed at its new path, even if its contents are
+	// the same as whatever was there before
+	d.ov.files[to] = &stagedFile{
+		data:       s.data,
+		mtime:      s.mtime,
+		executable: s.executable,
+	}
+	delete(d.ov.removed, to)
+
+	delete(d.ov.files, from)
+	if inBase {
+		d.ov.removed[from] = false
+	}
+	return nil
+}
+
+// BranchFile implements fs.Node, fs.NodeOpener, fs.NodeSetattrer, and
+// fs.NodeFsyncer for a file within a branch that was looked up while
+// --writable was provided. Syncing it commits all of the changes staged in the
+// branch's overlay.
+type BranchFile struct {
+	ov *overlay
+	// Path is the path to this file relative to the root of the repository.
+	Path string
+}
+
+func (f *BranchFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	f.ov.mu.Lock()
+	s, staged := f.ov.files[f.Path]
+	var size int
+	var mtime time.Time
+	var executable bool
+	if staged {
+		size, mtime, executable = len(s.data), s.mtime, s.executable
+	}
+	f.ov.mu.Unlock()
+
+	if staged {
+		a.Size = uint64(size)
+		a.Mtime = mtime
+	} else {
+		n, err := f.ov.base(ctx, f.Path)
+		if err != nil {
+			return err
+		}
+		base, ok := n.(*File)
+		if !ok {
+			return syscall.ENOENT
+		}
+
+		if err := base.Attr(ctx, a); err != nil {
+			return err
+		}
+		executable = base.Executable
+	}
+
+	a.Valid = cli.RepoTTL
+	a.Inode = f.ov.inode(f.Path)
+	var mode os.FileMode = 0o600
+	if executable {
+		mode |= 0o100
+	}
+	setMode(a, mode)
+	return nil
+}
+
+func (f *BranchFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	f.ov.mu.Lock()
+	_, staged := f.ov.files[f.Path]
+	f.ov.mu.Unlock()
+
+	// Files that are only being read don't have to be staged
+	if !staged && req.Flags.IsReadOnly() {
+		n, err := f.ov.base(ctx, f.Path)
+		if err != nil {
+			return nil, err
+		}
+		if base, ok := n.(*File); ok {
+			return base.Open(ctx, req, resp)
+		}
+	}
+	if !req.Flags.IsReadOnly() && !fromOwner(req.Header) {
+		return nil, syscall.EACCES
+	}
+
+	var err error
+	if req.Flags&fuse.OpenTruncate != 0 {
+		err = f.ov.modify(ctx, f.Path, func(s *stagedFile) {
+			s.data = s.data[:0]
+		})
+	} else {
+		_, err = f.ov.stage(ctx, f.Path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &branchHandle{f: f}, nil
+}
+
+func (f *BranchFile) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	// Only the size can be changed, since git doesn't record anything else
+	// that could be set here
+	if !req.Valid.Size() {
+		return nil
+	}
+	if !fromOwner(req.Header) {
+		return syscall.EACCES
+	}
+	if req.Size > maxFileSize {
+		return syscall.EFBIG
+	}
+
+	return f.ov.modify(ctx, f.Path, func(s *stagedFile) {
+		if int(req.Size) <= len(s.data) {
+			s.data = s.data[:req.Size]
+		} else {
+			s.data = append(s.data, make([]byte, int(req.Size)-len(s.data))...)
+		}
+	})
+}
+
+// Fsync commits just f, so that the other files that editors create while
+// saving, like swap files and backups, aren't committed along with it.
+func (f *BranchFile) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	if !fromOwner(req.Header) {
+		return syscall.EACCES
+	}
+
+	return f.ov.commit(ctx, "", f.Path)
+}
+
+// branchHandle implements fs.HandleReader and fs.HandleWriter for a
+// BranchFile that has been staged.
+type branchHandle struct {
+	f *BranchFile
+}
+
+func (h *branchHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	s, err := h.f.ov.stage(ctx, h.f.Path)
+	if err != nil {
+		return err
+	}
+
+	h.f.ov.mu.Lock()
+	defer h.f.ov.mu.Unlock()
+
+	if req.Offset < int64(len(s.data)) {
+		end := req.Offset + int64(req.Size)
+		if end > int64(len(s.data)) {
+			end = int64(len(s.data))
+		}
+		resp.Data = append(resp.Data[:0], s.data[req.Offset:end]...)
+	}
+	return nil
+}
+
+// Write is checked as well as Open, since handles can be passed to other users.
+func (h *branchHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if !fromOwner(req.Header) {
+		return syscall.EACCES
+	}
+	if req.Offset < 0 || req.Offset+int64(len(req.Data)) > maxFileSize {
+		return syscall.EFBIG
+	}
+
+	err := h.f.ov.modify(ctx, h.f.Path, func(s *stagedFile) {
+		end := int(req.Offset) + len(req.Data)
+		if end > len(s.data) {
+			s.data = append(s.data, make([]byte, end-len(s.data))...)
+		}
+		copy(s.data[req.Offset:], req.Data)
+	})
+	if err != nil {
+		return err
+	}
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+// CommitFile implements fs.Node and fs.HandleWriter for the .commit file of a
+// writable branch. Writing to it commits the changes staged in the branch's
+// overlay, using what was written as the commit message.
+type CommitFile struct {
+	ov *overlay
+}
+
+func (f *CommitFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	// CommitFile can be written but not read
+	setMode(a, 0o200)
+	return nil
+}
+
+func (f *CommitFile) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if !fromOwner(req.Header) {
+		return syscall.EACCES
+	}
+
+	if err := f.ov.commit(ctx, string(req.Data)); err != nil {
+		return err
+	}
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+// DiscardFile implements fs.Node and fs.HandleWriter for the .discard file of a
+// writable branch. Writing anything to it discards the changes staged in the
+// branch's overlay, and bases the branch's directory on the latest commit of
+// the branch.
+type DiscardFile struct {
+	ov *overlay
+}
+
+func (f *DiscardFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	// DiscardFile can be written but not read
+	setMode(a, 0o200)
+	return nil
+}
+
+func (f *DiscardFile) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if !fromOwner(req.Header) {
+		return syscall.EACCES
+	}
+
+	if err := f.ov.discard(ctx); err != nil {
+		return err
+	}
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+// CreateRefInput is the input of the createRef mutation. Its name is used as
+// the type of the mutation's variable, so it must match the schema.
+type CreateRefInput struct {
+	RepositoryId string `json:"repositoryId"`
+	Name         string `json:"name"`
+	Oid          string `json:"oid"`
+}
+
+// DeleteRefInput is the input of the deleteRef mutation. Its name is used as
+// the type of the mutation's variable, so it must match the schema.
+type DeleteRefInput struct {
+	RefId string `json:"refId"`
+}
+
+// branches reports whether l contains branches that can be modified, created,
+// and deleted.
+func (l *RefList) branches() bool {
+	return cli.Writable && strings.HasPrefix(l.Prefix, refsPrefixes["heads"])
+}
+
+// repoKey returns the lowercase owner and name of l's repository.
+func (l *RefList) repoKey() string {
+	return strings.ToLower(l.repo.Owner.Login + "/" + l.repo.Name)
+}
+
+// Mkdir creates a branch from the commit that branchBaseXattr resolves to, or
+// the head of the default branch if it isn't set.
+func (l *RefList) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	if !l.branches() {
+		return nil, syscall.EROFS
+	}
+	if !fromOwner(req.Header) {
+		return nil, syscall.EACCES
+	}
+	// No component of a ref name can begin with a period
+	if strings.HasPrefix(req.Name, ".") {
+		return nil, syscall.EINVAL
+	}
+
+	branchBases.Lock()
+	base, ok := branchBases.m[l.repoKey()]
+	branchBases.Unlock()
+	if !ok {
+		base = refsPrefixes["heads"] + l.repo.DefaultBranchRef.Name
+	}
+
+	var query struct {
+		Repository struct {
+			Object *refTarget `graphql:"object(expression: $expression)"`
+		} `graphql:"repository(name: $name, owner: $owner)"`
+	}
+	err := runQuery(ctx, "ResolveBranchBase", &query, map[string]interface{}{
+		"name":       graphql.String(l.repo.Name),
+		"owner":      graphql.String(l.repo.Owner.Login),
+		"expression": graphql.String(base),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if query.Repository.Object == nil {
+		return nil, syscall.ENOENT
+	}
+	oid, tree := query.Repository.Object.commit()
+	// Only commits have trees
+	if tree == "" {
+		return nil, syscall.EINVAL
+	}
+
+	var mutation struct {
+		CreateRef struct {
+			Ref struct{ Id string }
+		} `graphql:"createRef(input: $input)"`
+	}
+	err = runMutation(ctx, "CreateRef", &mutation,
+		map[string]interface{}{"input": CreateRefInput{
+			RepositoryId: l.repo.Id,
+			Name:         l.Prefix + req.Name,
+			Oid:          oid,
+		}})
+	if err != nil {
+		return nil, err
+	}
+
+	misses.delete(l.key(req.Name))
+	branch := strings.TrimPrefix(l.Prefix+req.Name, refsPrefixes["heads"])
+	return &BranchDir{ov: branchOverlay(l.repo, branch, oid, tree)}, nil
+}
+
+// Remove deletes a branch. Branches with staged changes can't be deleted,
+// since the changes would be lost.
+func (l *RefList) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if !l.branches() {
+		return syscall.EROFS
+	}
+	if !fromOwner(req.Header) {
+		return syscall.EACCES
+	}
+	if !req.Dir {
+		return syscall.EISDIR
+	}
+
+	branch := strings.TrimPrefix(l.Prefix+req.Name, refsPrefixes["heads"])
+	overlays.Lock()
+	ov := overlays.m[overlayKey(l.repo, branch)]
+	overlays.Unlock()
+	if ov != nil {
+		ov.mu.Lock()
+		staged := ov.staged()
+		ov.mu.Unlock()
+		if staged {
+			return syscall.ENOTEMPTY
+		}
+	}
+
+	var query struct {
+		Repository struct {
+			Ref *struct {
+				Id string
+			} `graphql:"ref(qualifiedName: $qualifiedName)"`
+			Refs struct {
+				TotalCount int
+			} `graphql:"refs(refPrefix: $refPrefix, first: 1)"`
+		} `graphql:"repository(name: $name, owner: $owner)"`
+	}
+	err := runQuery(ctx, "LookupRefId", &query, map[string]interface{}{
+		"name":          graphql.String(l.repo.Name),
+		"owner":         graphql.String(l.repo.Owner.Login),
+		"qualifiedName": graphql.String(l.Prefix + req.Name),
+		"refPrefix":     graphql.String(l.Prefix + req.Name + "/"),
+	})
+	if err != nil {
+		return err
+	}
+	// Directories of branches that only contain other branches can't be
+	// removed
+	if query.Repository.Ref == nil {
+		if query.Repository.Refs.TotalCount > 0 {
+			return syscall.ENOTEMPTY
+		}
+		return syscall.ENOENT
+	}
+
+	var mutation struct {
+		DeleteRef struct {
+			ClientMutationId string
+		} `graphql:"deleteRef(input: $input)"`
+	}
+	err = runMutation(ctx, "DeleteRef", &mutation,
+		map[string]interface{}{"input": DeleteRefInput{
+			RefId: query.Repository.Ref.Id,
+		}})
+	if err != nil {
+		return err
+	}
+
+	overlays.Lock()
+	delete(overlays.m, overlayKey(l.repo, branch))
+	overlays.Unlock()
+	miss(l.key(req.Name))
+	return nil
+}
+
+func (l *RefList) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	branchBases.Lock()
+	defer branchBases.Unlock()
+
+	base, ok := branchBases.m[l.repoKey()]
+	if req.Name != branchBaseXattr || !ok || !l.branches() {
+		return fuse.ErrNoXattr
+	}
+
+	resp.Xattr = append(resp.Xattr, base...)
+	return nil
+}
+
+func (l *RefList) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	branchBases.Lock()
+	defer branchBases.Unlock()
+
+	if _, ok := branchBases.m[l.repoKey()]; ok && l.branches() {
+		resp.Append(branchBaseXattr)
+	}
+	return nil
+}
+
+// Setxattr only supports branchBaseXattr, which applies to every directory of
+// branches within the repository.
+func (l *RefList) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	if !l.branches() {
+		return syscall.EROFS
+	}
+	if !fromOwner(req.Header) {
+		return syscall.EACCES
+	}
+	if req.Name != branchBaseXattr {
+		return syscall.ENOTSUP
+	}
+
+	branchBases.Lock()
+	defer branchBases.Unlock()
+
+	branchBases.m[l.repoKey()] = strings.TrimSpace(string(req.Xattr))
+	return nil
+}
+
+func (l *RefList) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	if !fromOwner(req.Header) {
+		return syscall.EACCES
+	}
+
+	branchBases.Lock()
+	defer branchBases.Unlock()
+
+	if _, ok := branchBases.m[l.repoKey()]; req.Name != branchBaseXattr || !ok {
+		return fuse.ErrNoXattr
+	}
+
+	delete(branchBases.m, l.repoKey())
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// cache is a map that is safe for concurrent use, whose entries expire ttl
+// after they're set. If ttl is 0, entries never expire.
+type cache[K comparable, V any] struct {
+	ttl time.Duration
+
+	mu sync.Mutex
+	m  map[K]cacheEntry[V]
+}
+
+type cacheEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+func newCache[K comparable, V any](ttl time.Duration) *cache[K, V] {
+	c := &cache[K, V]{ttl: ttl, m: map[K]cacheEntry[V]{}}
+	if ttl != 0 {
+		go c.sweep()
+	}
+	return c
+}
+
+// sweep removes expired entries once per ttl, so that entries that are never
+// read again don't occupy memory for as long as the filesystem is mounted.
+func (c *cache[K, V]) sweep() {
+	interval := c.ttl
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	for range time.Tick(interval) {
+		now := time.Now()
+		c.mu.Lock()
+		for k, e := range c.m {
+			if now.After(e.expires) {
+				delete(c.m, k)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// get returns the value for k, and whether an unexpired value was present.
+func (c *cache[K, V]) get(k K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.m[k]
+	if ok && c.ttl != 0 && time.Now().After(e.expires) {
+		delete(c.m, k)
+		ok = false
+	}
+	return e.value, ok
+}
+
+// set sets the value for k to v.
+func (c *cache[K, V]) set(k K, v V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.m[k] = cacheEntry[V]{value: v, expires: time.Now().Add(c.ttl)}
+}
+
+// delete removes the value for k, if there is one.
+func (c *cache[K, V]) delete(k K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.m, k)
+}
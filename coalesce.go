@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+	"syscall"
+)
+
+// flight is an api request in progress, which identical concurrent requests
+// wait for instead of making requests of their own.
+type flight struct {
+	// done is closed once the request has finished.
+	done chan struct{}
+	// response is a pointer to the response populated by the request, which
+	// is never modified once the request has finished.
+	response interface{}
+	err      error
+
+	// cancel aborts the request, which happens once everyone waiting for it
+	// has been interrupted.
+	cancel context.CancelFunc
+	// waiters is the number of callers waiting for the request, guarded by
+	// flights.
+	waiters int
+}
+
+// flights contains the requests in progress, keyed by their operation, the
+// type of their response, and their variables.
+var flights = struct {
+	sync.Mutex
+	m map[string]*flight
+}{m: map[string]*flight{}}
+
+// coalesce calls do to populate response, unless an identical request is
+// already in progress, in which case response is populated with the result of
+// that request instead. This way, concurrent identical requests, like the
+// lookups the kernel often issues in parallel, only cost a single round trip.
+//
+// If ctx is done before the request finishes, EINTR is returned, and the
+// request is aborted if no one else is waiting for it.
+func coalesce(ctx context.Context, op string, variables map[string]interface{}, response interface{}, do func(ctx context.Context, response interface{}) error) error {
+	// Variables are marshalled to get a key that doesn't depend on the order
+	// of the map
+	v, err := json.Marshal(variables)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s\x00%T\x00%s", op, response, v)
+
+	flights.Lock()
+	f, ok := flights.m[key]
+	if !ok {
+		// The request populates a response of its own, since the caller's
+		// response could be modified while others are still copying it. It
+		// also gets a context of its own, since it shouldn't be aborted while
+		// anyone is still waiting for it.
+		fctx, cancel := context.WithCancel(context.Background())
+		f = &flight{
+			done:     make(chan struct{}),
+			response: reflect.New(reflect.TypeOf(response).Elem()).Interface(),
+			cancel:   cancel,
+		}
+		flights.m[key] = f
+
+		go func() {
+			f.err = do(fctx, f.response)
+			cancel()
+
+			flights.Lock()
+			if flights.m[key] == f {
+				delete(flights.m, key)
+			}
+			flights.Unlock()
+			close(f.done)
+		}()
+	}
+	f.waiters++
+	flights.Unlock()
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		flights.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			f.cancel()
+			if flights.m[key] == f {
+				delete(flights.m, key)
+			}
+		}
+		flights.Unlock()
+
+		return syscall.EINTR
+	}
+
+	if f.err != nil {
+		return f.err
+	}
+
+	// The key includes the type of the response, so this can't panic
+	reflect.ValueOf(response).Elem().Set(reflect.ValueOf(f.response).Elem())
+	return nil
+}
+
+// runQuery runs the named GraphQL query derived from q through client,
+// populating q, coalescing identical concurrent queries. Errors are logged and
+// classified by errno.
+func runQuery(ctx context.Context, name string, q interface{}, variables map[string]interface{}) error {
+	return coalesce(ctx, name, variables, q,
+		func(ctx context.Context, q interface{}) error {
+			err := client.QueryWithContext(ctx, name, q, variables)
+			return logQueryError(ctx, name, variables, err)
+		})
+}
+
+// runRawQuery runs the named GraphQL query given as a string through client,
+// populating response, coalescing identical concurrent queries. Errors are
+// logged and classified by errno.
+func runRawQuery(ctx context.Context, name, query string, variables map[string]interface{}, response interface{}) error {
+	return coalesce(ctx, query, variables, response,
+		func(ctx context.Context, response interface{}) error {
+			err := client.DoWithContext(ctx, query, variables, response)
+			return logQueryError(ctx, name, variables, err)
+		})
+}
+
+// runMutation runs the named GraphQL mutation derived from m through client,
+// populating m. Unlike queries, mutations are never coalesced, since each of
+// them is meant to take effect. Errors are logged and classified by errno.
+func runMutation(ctx context.Context, name string, m interface{}, variables map[string]interface{}) error {
+	err := client.MutateWithContext(ctx, name, m, variables)
+	// The variables of mutations aren't logged, since they can contain the
+	// contents of whole files
+	return logQueryError(ctx, name, nil, err)
+}
+
+// logQueryError logs err, which was returned by the named query, unless the
+// query was aborted because everyone waiting for it was interrupted, and
+// returns it classified by errno. Queries are only logged once, however many
+// callers were waiting for them.
+func logQueryError(ctx context.Context, name string, variables map[string]interface{}, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if ctx.Err() == nil && variables != nil {
+		log.Printf("%s %v: %v", name, variables, err)
+	} else if ctx.Err() == nil {
+		log.Printf("%s: %v", name, err)
+	}
+	return errno(err)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// objects is the on-disk cache of git objects, or nil if it is disabled.
+var objects *diskCache
+
+// diskCache is a cache of git objects keyed by their oids. Objects are
+// immutable, so entries never have to be invalidated, and the cache is stored
+// on disk so it is shared between mounts. Once the cache exceeds its size
+// limit, the least recently used objects are evicted.
+type diskCache struct {
+	// dir is the directory the cache is stored in.
+	dir string
+	// limit is the maximum size of the cache in bytes.
+	limit int64
+
+	mu sync.Mutex
+	// size is the current size of the cache in bytes.
+	size int64
+}
+
+// Kinds of objects stored in a diskCache.
+const (
+	blobsKind = "blobs"
+	treesKind = "trees"
+)
+
+// openDiskCache opens the cache stored in dir, creating it if necessary.
+func openDiskCache(dir string, limit int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	c := &diskCache{dir: dir, limit: limit}
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		c.size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.evict()
+	return c, nil
+}
+
+// path returns the path of the object of the given kind and oid.
+func (c *diskCache) path(kind, oid string) string {
+	if len(oid) < 3 {
+		return filepath.Join(c.dir, kind, oid)
+	}
+	return filepath.Join(c.dir, kind, oid[:2], oid[2:])
+}
+
+// get returns the contents of the object of the given kind and oid, and
+// whether it was present.
+func (c *diskCache) get(kind, oid string) ([]byte, bool) {
+	if c == nil || oid == "" {
+		return nil, false
+	}
+
+	p := c.path(kind, oid)
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, false
+	}
+
+	// The modification time records when the object was last used, so that
+	// the least recently used objects can be evicted
+	now := time.Now()
+	_ = os.Chtimes(p, now, now)
+	return b, true
+}
+
+// put stores b as the contents of the object of the given kind and oid.
+// Failures are logged but otherwise ignored, since they only mean that the
+// object will have to be fetched again.
+func (c *diskCache) put(kind, oid string, b []byte) {
+	if c == nil || oid == "" || int64(len(b)) > c.limit {
+		return
+	}
+
+	p := c.path(kind, oid)
+	if _, err := os.Stat(p); err == nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		log.Println(err)
+		return
+	}
+
+	// Objects are written to a temporary file first so that concurrent readers
+	// never see partial objects
+	f, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		log.Println(err)
+		os.Remove(f.Name())
+		return
+	}
+
+	c.mu.Lock()
+	c.size += int64(len(b))
+	over := c.size > c.limit
+	c.mu.Unlock()
+
+	if over {
+		c.evict()
+	}
+}
+
+// getJSON decodes the object of the given kind and oid into v, reporting
+// whether it was present.
+func (c *diskCache) getJSON(kind, oid string, v interface{}) bool {
+	b, ok := c.get(kind, oid)
+	return ok && json.Unmarshal(b, v) == nil
+}
+
+// putJSON stores the JSON encoding of v as the object of the given kind and
+// oid.
+func (c *diskCache) putJSON(kind, oid string, v interface{}) {
+	if c == nil {
+		return
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	c.put(kind, oid, b)
+}
+
+// evict removes the least recently used objects until the cache is below 90%
+// of its limit, so that eviction doesn't happen after every put.
+func (c *diskCache) evict() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.size <= c.limit {
+		return
+	}
+
+	type object struct {
+		path  string
+		size  int64
+		mtime time.Time
+	}
+	var objects []object
+	_ = filepath.WalkDir(c.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		objects = append(objects, object{p, info.Size(), info.ModTime()})
+		return nil
+	})
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].mtime.Before(objects[j].mtime)
+	})
+
+	target := c.limit / 10 * 9
+	for _, o := range objects {
+		if c.size <= target {
+			break
+		}
+
+		if err := os.Remove(o.path); err != nil {
+			log.Println(err)
+			continue
+		}
+		c.size -= o.size
+	}
+}
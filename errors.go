@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/cli/go-gh/pkg/api"
+	graphql "github.com/cli/shurcooL-graphql"
+)
+
+// errno classifies err, which was returned by an api request, as the error
+// number that best describes it to the kernel, so that callers can tell apart
+// paths that don't exist, paths they aren't allowed to access, and requests
+// that might succeed if they are retried later.
+func errno(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var (
+		num     syscall.Errno
+		errnum  fuse.ErrorNumber
+		httpErr api.HTTPError
+		gqlErr  api.GQLError
+		gqlErrs graphql.Errors
+		netErr  net.Error
+	)
+	switch {
+	case errors.Is(err, context.Canceled):
+		return syscall.EINTR
+	case errors.Is(err, context.DeadlineExceeded):
+		return syscall.ETIMEDOUT
+	case errors.As(err, &num):
+		return num
+	case errors.As(err, &errnum):
+		// Errors like rateLimitError have been classified already
+		return errnum.Errno()
+	case errors.As(err, &httpErr):
+		return httpErrno(httpErr)
+	case errors.As(err, &gqlErr):
+		for _, e := range gqlErr.Errors {
+			if n, ok := gqlErrno(e.Type); ok {
+				return n
+			}
+		}
+	case errors.As(err, &gqlErrs):
+		for _, e := range gqlErrs {
+			if n, ok := gqlErrno(e.Type); ok {
+				return n
+			}
+		}
+	case errors.As(err, &netErr):
+		if netErr.Timeout() {
+			return syscall.ETIMEDOUT
+		}
+		return syscall.EHOSTUNREACH
+	}
+
+	return syscall.EIO
+}
+
+// httpErrno returns the error number for an unsuccessful http response.
+func httpErrno(err api.HTTPError) syscall.Errno {
+	switch err.StatusCode {
+	case http.StatusNotFound, http.StatusGone:
+		return syscall.ENOENT
+	case http.StatusForbidden:
+		// Exhausted rate limits are also reported as forbidden
+		if err.Headers.Get("X-RateLimit-Remaining") == "0" ||
+			err.Headers.Get("Retry-After") != "" {
+			return syscall.EAGAIN
+		}
+		return syscall.EACCES
+	case http.StatusUnauthorized:
+		return syscall.EACCES
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return syscall.EAGAIN
+	}
+	return syscall.EIO
+}
+
+// gqlErrno returns the error number for a GraphQL error of the given type, and
+// whether there is one.
+func gqlErrno(typ string) (syscall.Errno, bool) {
+	switch typ {
+	case "NOT_FOUND":
+		return syscall.ENOENT, true
+	case "FORBIDDEN", "UNAUTHORIZED", "SAML_FAILURE":
+		return syscall.EACCES, true
+	case "RATE_LIMITED":
+		return syscall.EAGAIN, true
+	}
+	return 0, false
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// inode returns a deterministic inode number derived from parts, which should
+// uniquely identify a node. Github node ids are globally unique, so they can
+// be used on their own.
+func inode(parts ...string) uint64 {
+	h := fnv.New64a()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+
+	// 0 means that a dynamic inode should be chosen, and 1 belongs to the root
+	i := h.Sum64()
+	if i <= 1 {
+		i += 2
+	}
+	return i
+}
+
+// blobInode returns the inode number of the blob with the given oid at path
+// in r. It doesn't depend on the revision being viewed, so the same file at
+// different revisions has the same inode number unless its contents changed,
+// which is exactly when tools like rsync -H and git status should treat it as
+// the same file.
+func blobInode(r *Repo, path, oid string) uint64 {
+	return inode("blob", r.Id, path, oid)
+}
+
+// treeInode returns the inode number of the tree at path in r, viewed at rev
+// through via, the ref or commit directory that the tree was reached through.
+// Unlike blobs, identical trees at different revisions, or reached through
+// different refs, get different inode numbers, because directories can't be
+// hard links, and tools like du skip directories whose inode numbers they've
+// already seen.
+func treeInode(r *Repo, rev, via, path string) uint64 {
+	return inode("tree", r.Id, rev, via, path)
+}
+
+// refInode returns the inode number of the ref or RefList in r with the given
+// fully qualified name or prefix. Git doesn't allow a ref's name to be a prefix
+// of another's, so a ref and a RefList never share a name, and the entries of
+// RefLists can be given inode numbers before it's known which they are.
+func refInode(r *Repo, name string) uint64 {
+	return inode(r.Id, strings.TrimSuffix(name, "/"))
+}
+
+// GenerateInode implements fs.FSInodeGenerator, for the nodes that don't have
+// inode numbers of their own, by deriving one from the node's parent and name.
+func (FS) GenerateInode(parentInode uint64, name string) uint64 {
+	return inode(strconv.FormatUint(parentInode, 16), name)
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	graphql "github.com/cli/shurcooL-graphql"
+)
+
+// issuesDirName is the name of the hidden directory within each repository
+// that contains that repository's issues.
+const issuesDirName = ".issues"
+
+// issueSlugLength is the maximum number of characters of an issue's title
+// that are included in the name of its file.
+const issueSlugLength = 50
+
+// issueStates maps the names of the entries within Issues to the state of the
+// issues that they contain.
+var issueStates = map[string]IssueState{
+	"open":   "OPEN",
+	"closed": "CLOSED",
+}
+
+// IssueState is the state of an issue. Its name is used as the type of query
+// variables, so it must match the schema.
+type IssueState string
+
+// Issues implements fs.Node, fs.NodeRequestLookuper, and HandleReadDirAller
+// for the .issues directory of a repository, which contains the open and
+// closed directories.
+type Issues struct {
+	// Repo is the repository that these issues belong to.
+	repo *Repo
+}
+
+func (i *Issues) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Valid = cli.RepoTTL
+	a.Inode = inode(i.repo.Id, issuesDirName)
+	// Issues can be read but not written
+	setMode(a, os.ModeDir|0o500)
+	a.Mtime = i.repo.UpdatedAt
+	a.Ctime = i.repo.UpdatedAt
+	return nil
+}
+
+func (i *Issues) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	resp.EntryValid = cli.ObjectTTL
+	state, ok := issueStates[req.Name]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+
+	return &IssueList{State: state, repo: i.repo}, nil
+}
+
+func (i *Issues) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	e := make([]fuse.Dirent, 0, len(issueStates))
+	for _, name := range []string{"open", "closed"} {
+		e = append(e, fuse.Dirent{
+			Inode: inode(i.repo.Id, issuesDirName, name),
+			Type:  fuse.DT_Dir,
+			Name:  name,
+		})
+	}
+	return e, nil
+}
+
+// IssueList implements fs.Node, fs.NodeRequestLookuper, and HandleReadDirAller
+// for a directory of the issues in a repository with a given state. Each issue
+// is a markdown file named by its number and a slug of its title.
+type IssueList struct {
+	// State is the state shared by all issues within this directory.
+	State IssueState
+	// Repo is the repository that these issues belong to.
+	repo *Repo
+}
+
+func (l *IssueList) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Valid = cli.RepoTTL
+	a.Inode = inode(l.repo.Id, issuesDirName, strings.ToLower(string(l.State)))
+	// IssueList can be read but not written
+	setMode(a, os.ModeDir|0o500)
+	a.Mtime = l.repo.UpdatedAt
+	a.Ctime = l.repo.UpdatedAt
+	return nil
+}
+
+// issueFileName returns the name of the file of the issue with the given
+// number and title.
+func issueFileName(number int, title string) string {
+	var slug strings.Builder
+	var n int
+	hyphen := false
+	for _, c := range strings.ToLower(title) {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+			hyphen = true
+			continue
+		}
+
+		if hyphen && slug.Len() > 0 {
+			slug.WriteByte('-')
+			n++
+		}
+		hyphen = false
+		slug.WriteRune(c)
+		n++
+		if n >= issueSlugLength {
+			break
+		}
+	}
+
+	if slug.Len() == 0 {
+		return fmt.Sprintf("%d.md", number)
+	}
+	return fmt.Sprintf("%d-%s.md", number, slug.String())
+}
+
+type issueComments struct {
+	Nodes []struct {
+		Author    *struct{ Login string }
+		Body      string
+		CreatedAt time.Time
+	}
+	PageInfo struct {
+		EndCursor   string
+		HasNextPage bool
+	}
+}
+
+// issueKey identifies an issue in issueSummaries and renderedIssues.
+type issueKey struct {
+	owner, name string
+	number      int
+}
+
+// issueSummary is what is needed to find an issue's file and its attributes,
+// without fetching its body and comments.
+type issueSummary struct {
+	Title     string
+	State     IssueState
+	UpdatedAt time.Time
+}
+
+// issueSummaries caches the summaries of issues that were listed or looked up,
+// so that stats of the entries of a listing don't each cost a query. Issues
+// can change at any time, so summaries are kept for --repo-ttl.
+var issueSummaries *cache[issueKey, issueSummary]
+
+// rememberIssue records the summary of the issue with the given key.
+func rememberIssue(key issueKey, issue issueSummary) {
+	if cli.RepoTTL == 0 {
+		return
+	}
+
+	issueSummaries.set(key, issue)
+}
+
+// renderedIssueTTL is how long rendered issues are cached in memory for. They
+// are only used while the issue hasn't been updated since it was rendered, so
+// this only limits how long they occupy memory.
+const renderedIssueTTL = 10 * time.Minute
+
+// renderedIssue is an issue rendered as markdown, as of when it was last
+// updated.
+type renderedIssue struct {
+	data      []byte
+	updatedAt time.Time
+}
+
+// renderedIssues caches rendered issues, so that reopening an issue that
+// hasn't been updated doesn't fetch it again.
+var renderedIssues = newCache[issueKey, renderedIssue](renderedIssueTTL)
+
+func (l *IssueList) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	// Issues can be edited, closed, and commented on at any time
+	resp.EntryValid = cli.RepoTTL
+
+	// Anything that isn't named like an issue's file can be answered locally
+	if !strings.HasSuffix(req.Name, ".md") {
+		return nil, syscall.ENOENT
+	}
+	prefix, _, _ := strings.Cut(strings.TrimSuffix(req.Name, ".md"), "-")
+	number, err := strconv.Atoi(prefix)
+	if err != nil || number <= 0 || strconv.Itoa(number) != prefix {
+		return nil, syscall.ENOENT
+	}
+
+	key := issueKey{l.repo.Owner.Login, l.repo.Name, number}
+	issue, ok := issueSummaries.get(key)
+	if !ok {
+		var query struct {
+			Repository struct {
+				Issue *issueSummary `graphql:"issue(number: $number)"`
+			} `graphql:"repository(name: $name, owner: $owner)"`
+		}
+		err = runQuery(ctx, "LookupIssue", &query, map[string]interface{}{
+			"name":   graphql.String(l.repo.Name),
+			"owner":  graphql.String(l.repo.Owner.Login),
+			"number": graphql.Int(number),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if query.Repository.Issue == nil {
+			return nil, syscall.ENOENT
+		}
+
+		issue = *query.Repository.Issue
+		rememberIssue(key, issue)
+	}
+
+	// Issues are found at the name they are listed with in the directory of
+	// their current state, and nowhere else
+	if issue.State != l.State || issueFileName(number, issue.Title) != req.Name {
+		return nil, syscall.ENOENT
+	}
+
+	return &IssueFile{Number: number, UpdatedAt: issue.UpdatedAt,
+		repo: l.repo}, nil
+}
+
+// issueAuthor returns how author is displayed in an issue's file. Authors
+// whose accounts have been deleted are displayed as @ghost, like on github.
+func issueAuthor(author *struct{ Login string }) string {
+	if author == nil {
+		return "@ghost"
+	}
+	return "@" + author.Login
+}
+
+type issuesQuery struct {
+	Edges []struct {
+		Node struct {
+			Number    int
+			Title     string
+			UpdatedAt time.Time
+		}
+	}
+	PageInfo struct {
+		EndCursor   string
+		HasNextPage bool
+	}
+}
+
+func (l *IssueList) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	var iq struct {
+		Repository struct {
+			Issues issuesQuery `graphql:"issues(states: $states, first: 100)"`
+		} `graphql:"repository(name: $name, owner: $owner)"`
+	}
+	err := runQuery(ctx, "GetIssues", &iq, map[string]interface{}{
+		"name":   graphql.String(l.repo.Name),
+		"owner":  graphql.String(l.repo.Owner.Login),
+		"states": []IssueState{l.State},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var e []fuse.Dirent
+	add := func(q issuesQuery) {
+		for _, i := range q.Edges {
+			rememberIssue(issueKey{l.repo.Owner.Login, l.repo.Name,
+				i.Node.Number}, issueSummary{Title: i.Node.Title,
+				State: l.State, UpdatedAt: i.Node.UpdatedAt})
+
+			e = append(e, fuse.Dirent{
+				Inode: inode(l.repo.Id, issuesDirName, strconv.Itoa(i.Node.Number)),
+				Type:  fuse.DT_File,
+				Name:  issueFileName(i.Node.Number, i.Node.Title),
+			})
+		}
+	}
+	add(iq.Repository.Issues)
+
+	var sq struct {
+		Repository struct {
+			Issues issuesQuery `graphql:"issues(states: $states, first: 100, after: $after)"`
+		} `graphql:"repository(name: $name, owner: $owner)"`
+	}
+	sq.Repository.Issues = iq.Repository.Issues
+
+	for sq.Repository.Issues.PageInfo.HasNextPage {
+		err := runQuery(ctx, "GetIssues", &sq, map[string]interface{}{
+			"after":  graphql.String(sq.Repository.Issues.PageInfo.EndCursor),
+			"name":   graphql.String(l.repo.Name),
+			"owner":  graphql.String(l.repo.Owner.Login),
+			"states": []IssueState{l.State},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		add(sq.Repository.Issues)
+	}
+
+	return e, nil
+}
+
+// IssueFile implements fs.Node and fs.NodeOpener for an issue, which contains
+// the issue's title, labels, assignees, and body, followed by all of its
+// comments, rendered as markdown when it is opened.
+type IssueFile struct {
+	// Number is the issue's number within its repository.
+	Number int
+	// UpdatedAt is the time the issue was last updated. This is used as the
+	// mtime and ctime.
+	UpdatedAt time.Time
+
+	// Repo is the repository that this issue belongs to.
+	repo *Repo
+}
+
+func (f *IssueFile) key() issueKey {
+	return issueKey{f.repo.Owner.Login, f.repo.Name, f.Number}
+}
+
+// Attr only knows the size of issues that have been rendered since they were
+// last updated. Issues are opened with direct I/O, so their contents are read
+// in full regardless.
+func (f *IssueFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Valid = cli.RepoTTL
+	a.Inode = inode(f.repo.Id, issuesDirName, strconv.Itoa(f.Number))
+	// IssueFile can be read but not written
+	setMode(a, 0o400)
+	if r, ok := renderedIssues.get(f.key()); ok && !r.updatedAt.Before(f.UpdatedAt) {
+		a.Size = uint64(len(r.data))
+	}
+	a.Mtime = f.UpdatedAt
+	a.Ctime = f.UpdatedAt
+	return nil
+}
+
+func (f *IssueFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if r, ok := renderedIssues.get(f.key()); ok && !r.updatedAt.Before(f.UpdatedAt) {
+		resp.Flags |= fuse.OpenDirectIO
+		return fileData(r.data), nil
+	}
+
+	var iq struct {
+		Repository struct {
+			Issue *struct {
+				Title     string
+				State     IssueState
+				Author    *struct{ Login string }
+				Body      string
+				CreatedAt time.Time
+				UpdatedAt time.Time
+				Labels    struct {
+					Nodes []struct{ Name string }
+				} `graphql:"labels(first: 100)"`
+				Assignees struct {
+					Nodes []struct{ Login string }
+				} `graphql:"assignees(first: 100)"`
+				Comments issueComments `graphql:"comments(first: 100)"`
+			} `graphql:"issue(number: $number)"`
+		} `graphql:"repository(name: $name, owner: $owner)"`
+	}
+	err := runQuery(ctx, "GetIssue", &iq, map[string]interface{}{
+		"name":   graphql.String(f.repo.Name),
+		"owner":  graphql.String(f.repo.Owner.Login),
+		"number": graphql.Int(f.Number),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	issue := iq.Repository.Issue
+	if issue == nil {
+		return nil, syscall.ENOENT
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s (#%d)\n\n", issue.Title, f.Number)
+	fmt.Fprintf(&b, "- State: %s\n", strings.ToLower(string(issue.State)))
+	fmt.Fprintf(&b, "- Author: %s\n", issueAuthor(issue.Author))
+	if len(issue.Labels.Nodes) > 0 {
+		labels := make([]string, 0, len(issue.Labels.Nodes))
+		for _, label := range issue.Labels.Nodes {
+			labels = append(labels, label.Name)
+		}
+		fmt.Fprintf(&b, "- Labels: %s\n", strings.Join(labels, ", "))
+	}
+	if len(issue.Assignees.Nodes) > 0 {
+		assignees := make([]string, 0, len(issue.Assignees.Nodes))
+		for _, assignee := range issue.Assignees.Nodes {
+			assignees = append(assignees, "@"+assignee.Login)
+		}
+		fmt.Fprintf(&b, "- Assignees: %s\n", strings.Join(assignees, ", "))
+	}
+	fmt.Fprintf(&b, "- Created: %s\n", issue.CreatedAt.Format(time.RFC3339))
+	if body := strings.TrimSpace(issue.Body); body != "" {
+		fmt.Fprintf(&b, "\n%s\n", body)
+	}
+
+	add := func(c issueComments) {
+		for _, comment := range c.Nodes {
+			fmt.Fprintf(&b, "\n---\n\n## %s commented on %s\n\n%s\n",
+				issueAuthor(comment.Author),
+				comment.CreatedAt.Format(time.RFC3339),
+				strings.TrimSpace(comment.Body))
+		}
+	}
+	add(issue.Comments)
+
+	var sq struct {
+		Repository struct {
+			Issue struct {
+				Comments issueComments `graphql:"comments(first: 100, after: $after)"`
+			} `graphql:"issue(number: $number)"`
+		} `graphql:"repository(name: $name, owner: $owner)"`
+	}
+	sq.Repository.Issue.Comments = issue.Comments
+
+	for sq.Repository.Issue.Comments.PageInfo.HasNextPage {
+		err := runQuery(ctx, "GetIssueComments", &sq, map[string]interface{}{
+			"after":  graphql.String(sq.Repository.Issue.Comments.PageInfo.EndCursor),
+			"name":   graphql.String(f.repo.Name),
+			"owner":  graphql.String(f.repo.Owner.Login),
+			"number": graphql.Int(f.Number),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		add(sq.Repository.Issue.Comments)
+	}
+
+	data := []byte(b.String())
+	renderedIssues.set(f.key(), renderedIssue{data: data,
+		updatedAt: issue.UpdatedAt})
+
+	// The issue may have changed since its size was reported, so it is read
+	// without regard to it
+	resp.Flags |= fuse.OpenDirectIO
+	return fileData(data), nil
+}
@@ -4,8 +4,10 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -18,84 +20,229 @@ import (
 	graphql "github.com/cli/shurcooL-graphql"
 )
 
-// TODO: allow write access to the authenticated user's directory? This could be
-// dangerous; it should probably be disabled by default with a flag to enable
-// it. We can't provide write access to files inside repositories, but we could
-// allow users to create/delete repos by creating/deleting directories in their
-// user directory.
-
 var cli struct {
 	MountPoint string `arg:"" help:"Where the filesystem should be mounted." type:"existingdir"`
+
+	AllowOther         bool `help:"Allow users other than the one mounting the filesystem to access it."`
+	DefaultPermissions bool `help:"Have the kernel enforce permissions based on each file's mode."`
+
+	CacheDir  string `help:"Where git objects should be cached. Defaults to gh-fs within the user cache directory." type:"path"`
+	CacheSize int64  `help:"Maximum size of the object cache in MiB, or 0 to disable it." default:"1024"`
+
+	AllowRepoManagement bool `help:"Allow repositories to be created and deleted by creating and removing directories in the authenticated user's directory, and those of organizations they administer."`
+	Writable            bool `help:"Allow branches under .refs/heads to be created, deleted, and modified. Changes to files are staged in memory, and committed to their branch when a file is synced or the branch's .commit file is written to."`
+
+	Prefetch bool `help:"Fetch the whole tree of each repository the first time it is listed, to speed up recursive traversal."`
+
+	MaxRequests     int    `help:"Maximum number of api requests in flight at once." default:"8"`
+	RateLimitPolicy string `help:"What to do when the rate limit is exhausted: block until it resets, or fail with EAGAIN." enum:"block,fail" default:"block"`
+
+	SnapshotTTL  time.Duration `help:"How long each repository stays pinned to a commit before its default branch is resolved again, or 0 to only do so when its .refresh file is written to." default:"5m"`
+	PollInterval time.Duration `help:"How often repositories are checked for pushes to their default branch, which re-pins them to the new commit, or 0 to disable polling. Polling is also disabled if --snapshot-ttl is 0." default:"1m"`
+
+	NegativeTTL time.Duration `help:"How long paths that were found not to exist are remembered, or 0 to always look them up." default:"1m"`
+	Ignore      []string      `help:"Names that are never looked up as users, organizations, or repositories, because other programs commonly probe for them." default:".git,.hg,.svn,.bzr,.envrc,.direnv,.venv,node_modules,.DS_Store,._.DS_Store,Desktop.ini,desktop.ini,Thumbs.db,autorun.inf,.Trash,.hidden,.xdg-volume-info,.localized"`
+
+	OwnerTTL  time.Duration `help:"How long the kernel may cache users and organizations." default:"1m"`
+	RepoTTL   time.Duration `help:"How long the kernel may cache repositories and refs." default:"1m"`
+	ObjectTTL time.Duration `help:"How long the kernel may cache files and directories within a commit, which never change." default:"24h"`
 }
 
 // TODO: does this have to be refreshed?
 var client api.GQLClient
 
+// restClient is used for the few requests that can't be made through the
+// GraphQL api.
+var restClient api.RESTClient
+
 func main() {
 	kong.Parse(&cli)
 
 	var err error
 
-	// TODO: investigate whether manually caching would be better, and how this
-	// caching actually works, cause it might not be doing what we want it to
-	client, err = gh.GQLClient(&api.ClientOptions{EnableCache: true})
+	sched = newScheduler(http.DefaultTransport, cli.MaxRequests,
+		cli.RateLimitPolicy)
+
+	// GraphQL responses aren't cached by go-gh, since it would serve them for
+	// a day regardless of what they contain, which would keep snapshots from
+	// being refreshed and hide the rate limit from sched. Responses that can't
+	// change are cached manually instead, like listings and objects.
+	client, err = gh.GQLClient(&api.ClientOptions{Transport: sched})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// Only GET requests are cached, and those are only made for objects by
+	// their ids, so their responses never change. The other requests made with
+	// this client delete and transfer repositories, and aren't cached.
+	restClient, err = gh.RESTClient(&api.ClientOptions{
+		EnableCache: true,
+		Transport:   sched,
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// Blobs are cached in objects instead, since they never change
+	rawClient, err = gh.RESTClient(&api.ClientOptions{
+		Headers:   map[string]string{"Accept": "application/vnd.github.raw"},
+		Transport: sched,
+	})
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	c, err := fuse.Mount(
-		cli.MountPoint,
+	seedRateLimit()
+
+	misses = newCache[string, struct{}](cli.NegativeTTL)
+	repoNames = newCache[string, map[string]bool](cli.NegativeTTL)
+	issueSummaries = newCache[issueKey, issueSummary](cli.RepoTTL)
+
+	if cli.CacheSize > 0 {
+		if cli.CacheDir == "" {
+			dir, err := os.UserCacheDir()
+			if err != nil {
+				log.Fatalln(err)
+			}
+			cli.CacheDir = filepath.Join(dir, "gh-fs")
+		}
+
+		objects, err = openDiskCache(cli.CacheDir, cli.CacheSize<<20)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	options := []fuse.MountOption{
 		fuse.FSName("github"),
 		fuse.Subtype("gh-fs"),
-	)
+	}
+	if cli.AllowOther {
+		options = append(options, fuse.AllowOther())
+	}
+	if cli.DefaultPermissions {
+		options = append(options, fuse.DefaultPermissions())
+	}
+
+	c, err := fuse.Mount(cli.MountPoint, options...)
 	if err != nil {
 		log.Fatalln(err)
 	}
 	defer c.Close()
 
-	err = fs.Serve(c, FS{})
+	srv = fs.New(c, nil)
+	// Repositories are only re-pinned when their .refresh file is written to
+	// if --snapshot-ttl is 0
+	if cli.PollInterval > 0 && cli.SnapshotTTL != 0 {
+		go pollRepos(cli.PollInterval)
+	}
+	go sweepRepoDirs()
+
+	err = srv.Serve(FS{})
 	if err != nil {
 		log.Fatalln(err)
 	}
 }
 
+// srv is the server for the mounted filesystem, which is used to invalidate
+// entries the kernel has cached once they change.
+var srv *fs.Server
+
 // FS implements fs.FS. Permissions are set so only the user that this mount
 // belongs to can do anything, so other users don't abuse the logged in user's
-// api access.
+// api access, unless --allow-other is provided.
 type FS struct{}
 
+// uid and gid are the ids of the user and group that mounted the filesystem,
+// which own every node.
+var uid, gid = uint32(os.Getuid()), uint32(os.Getgid())
+
+// setMode sets the owner of a to the mounting user, and its mode to mode,
+// which should only contain permissions for the owner. If --allow-other was
+// provided, the group and others are given the same read and execute
+// permissions as the owner, but never write permission, since changes are made
+// with the mounting user's token.
+func setMode(a *fuse.Attr, mode os.FileMode) {
+	a.Uid, a.Gid = uid, gid
+	if cli.AllowOther {
+		perm := mode & 0o500
+		mode |= perm>>3 | perm>>6
+	}
+	a.Mode = mode
+}
+
+// fromOwner reports whether h belongs to a request made by the mounting user.
+// Handlers that make changes check this themselves, since the kernel only
+// enforces modes if --default-permissions is provided.
+func fromOwner(h fuse.Header) bool {
+	return h.Uid == uid
+}
+
 func (FS) Root() (fs.Node, error) {
 	return Root{}, nil
 }
 
-// Root implements fs.Node, fs.NodeStringLookuper, and HandleReadDirAller for
-// the root of the filesystem, which contains users.
+// Root implements fs.Node, fs.NodeRequestLookuper, and HandleReadDirAller for
+// the root of the filesystem, which contains users and organizations.
 type Root struct{}
 
 func (Root) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Valid = cli.OwnerTTL
 	a.Inode = 0
 	// Root can be read but not written
-	a.Mode = os.ModeDir | 0o044
+	setMode(a, os.ModeDir|0o500)
 	return nil
 }
 
-func (Root) Lookup(ctx context.Context, name string) (fs.Node, error) {
-	var query struct {
-		User *User `graphql:"user(login: $login)"`
+func (Root) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	resp.EntryValid = cli.OwnerTTL
+
+	// Names that can't be logins are answered locally, since they are mostly
+	// programs probing for files like .git or Desktop.ini
+	if !validLogin(req.Name) || ignored(req.Name) ||
+		missed(strings.ToLower(req.Name)) {
+		return nil, syscall.ENOENT
 	}
-	err := client.Query("LookupUser", &query,
-		map[string]interface{}{"login": graphql.String(name)})
+
+	var query struct {
+		RepositoryOwner *struct {
+			Typename string `graphql:"__typename"`
+			Id       string
+			Login    string
+			User     struct {
+				IsViewer bool
+			} `graphql:"... on User"`
+			Organization struct {
+				ViewerCanAdminister bool
+			} `graphql:"... on Organization"`
+		} `graphql:"repositoryOwner(login: $login)"`
+	}
+	err := runQuery(ctx, "LookupOwner", &query,
+		map[string]interface{}{"login": graphql.String(req.Name)})
 	if err != nil {
-		log.Println(err)
 		return nil, err
 	}
 
-	return query.User, nil
+	if query.RepositoryOwner == nil {
+		miss(strings.ToLower(req.Name))
+		return nil, syscall.ENOENT
+	}
+
+	owner := query.RepositoryOwner
+	switch owner.Typename {
+	case "Organization":
+		return &Org{Id: owner.Id, Login: owner.Login,
+			ViewerCanAdminister: owner.Organization.ViewerCanAdminister}, nil
+	default:
+		return &User{Id: owner.Id, Login: owner.Login,
+			IsViewer: owner.User.IsViewer}, nil
+	}
 }
 
 type followingQuery struct {
 	Edges []struct {
 		Node struct {
+			Id    string
 			Login string
 		}
 	}
@@ -105,35 +252,50 @@ type followingQuery struct {
 	}
 }
 
-// Root conceptually contains all users, but we can't actually display that, so
-// instead we display the users followed by the authenticated user, and the
-// authenticated user themself. This means those will be the only visible
-// folders, but all other users can still be accessed via lookup.
+type organizationsQuery struct {
+	Edges []struct {
+		Node struct {
+			Id    string
+			Login string
+		}
+	}
+	PageInfo struct {
+		EndCursor   string
+		HasNextPage bool
+	}
+}
+
+// Root conceptually contains all users and organizations, but we can't
+// actually display that, so instead we display the users followed by the
+// authenticated user, the organizations they belong to, and the authenticated
+// user themself. This means those will be the only visible folders, but all
+// other users and organizations can still be accessed via lookup.
 func (Root) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	// TODO: include owners of repos the current user has starred too
 
 	var iq struct {
 		Viewer struct {
-			Login     string
-			Following followingQuery `graphql:"following(first: 100)"`
+			Id            string
+			Login         string
+			Following     followingQuery     `graphql:"following(first: 100)"`
+			Organizations organizationsQuery `graphql:"organizations(first: 100)"`
 		}
 	}
-	err := client.Query("GetViewerAndFollowing", &iq, nil)
+	err := runQuery(ctx, "GetViewerFollowingAndOrganizations", &iq, nil)
 	if err != nil {
-		log.Println(err)
 		return nil, err
 	}
 
 	e := make([]fuse.Dirent, len(iq.Viewer.Following.Edges)+1)
 	e[0] = fuse.Dirent{
-		// TODO: Inode: iq.Viewer.Id,
-		Type: fuse.DT_Dir,
-		Name: iq.Viewer.Login}
+		Inode: inode(iq.Viewer.Id),
+		Type:  fuse.DT_Dir,
+		Name:  iq.Viewer.Login}
 	for i, f := range iq.Viewer.Following.Edges {
 		e[i+1] = fuse.Dirent{
-			// TODO: Inode: iq.Viewer.Id,
-			Type: fuse.DT_Dir,
-			Name: f.Node.Login}
+			Inode: inode(f.Node.Id),
+			Type:  fuse.DT_Dir,
+			Name:  f.Node.Login}
 	}
 
 	var sq struct {
@@ -145,61 +307,109 @@ func (Root) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	sq.Viewer.Following.PageInfo = iq.Viewer.Following.PageInfo
 
 	for sq.Viewer.Following.PageInfo.HasNextPage {
-		err := client.Query("GetFollowing", &sq, map[string]interface{}{
+		err := runQuery(ctx, "GetFollowing", &sq, map[string]interface{}{
 			"after": sq.Viewer.Following.PageInfo.EndCursor})
 
 		if err != nil {
-			log.Println(err)
 			return nil, err
 		}
 
 		ne := make([]fuse.Dirent, len(sq.Viewer.Following.Edges))
 		for i, f := range sq.Viewer.Following.Edges {
 			ne[i] = fuse.Dirent{
-				// TODO: Inode: f.Node.Id,
-				Type: fuse.DT_Dir,
-				Name: f.Node.Login}
+				Inode: inode(f.Node.Id),
+				Type:  fuse.DT_Dir,
+				Name:  f.Node.Login}
 		}
 		e = append(e, ne...)
 	}
 
+	var oq struct {
+		Viewer struct {
+			Organizations organizationsQuery `graphql:"organizations(first: 100, after: $after)"`
+		}
+	}
+	oq.Viewer.Organizations = iq.Viewer.Organizations
+
+	for {
+		for _, o := range oq.Viewer.Organizations.Edges {
+			e = append(e, fuse.Dirent{
+				Inode: inode(o.Node.Id),
+				Type:  fuse.DT_Dir,
+				Name:  o.Node.Login})
+		}
+
+		if !oq.Viewer.Organizations.PageInfo.HasNextPage {
+			break
+		}
+
+		err := runQuery(ctx, "GetOrganizations", &oq, map[string]interface{}{
+			"after": graphql.String(oq.Viewer.Organizations.PageInfo.EndCursor)})
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return e, nil
 }
 
-// User implements fs.Node, fs.NodeStringLookuper, and HandleReadDirAller for
-// a user directory, which contains the user's repositories.
+// User implements fs.Node, fs.NodeRequestLookuper, and HandleReadDirAller for
+// a user directory, which contains the user's repositories. It also implements
+// fs.NodeMkdirer, fs.NodeRemover, and fs.NodeRenamer, which create, delete,
+// rename, and transfer repositories in the authenticated user's directory if
+// --allow-repo-management is provided.
 type User struct {
+	// Id is the user's github node id.
+	Id string
 	// Login is the user's github username, which is unique.
 	Login string
+	// IsViewer is whether this is the authenticated user.
+	IsViewer bool
 }
 
 func (u *User) Attr(ctx context.Context, a *fuse.Attr) error {
-	// TODO: a.Inode =
-	// User can be read but not written
-	a.Mode = os.ModeDir | 0o044
+	a.Valid = cli.OwnerTTL
+	a.Inode = inode(u.Id)
+	// User can only be written if repositories can be created and deleted in
+	// it
+	if u.manageable() {
+		setMode(a, os.ModeDir|0o700)
+	} else {
+		setMode(a, os.ModeDir|0o500)
+	}
 
 	// TODO: set other equivalent information
 
 	return nil
 }
 
-func (u *User) Lookup(ctx context.Context, name string) (fs.Node, error) {
+func (u *User) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	resp.EntryValid = cli.RepoTTL
+	return lookupRepoDir(ctx, u.Login, req.Name)
+}
+
+// lookupRepo looks up the repository with the given owner and name, returning
+// ENOENT if there is no such repository.
+func lookupRepo(ctx context.Context, owner, name string) (*Repo, error) {
 	var query struct {
 		Repository *Repo `graphql:"repository(owner: $owner, name: $name)"`
 	}
-	err := client.Query("LookupRepo", &query, map[string]interface{}{
-		"owner": graphql.String(u.Login), "name": graphql.String(name)})
+	err := runQuery(ctx, "LookupRepo", &query, map[string]interface{}{
+		"owner": graphql.String(owner), "name": graphql.String(name)})
 	if err != nil {
-		log.Println(err)
 		return nil, err
 	}
 
+	if query.Repository == nil {
+		return nil, syscall.ENOENT
+	}
 	return query.Repository, nil
 }
 
 type repositoriesQuery struct {
 	Edges []struct {
 		Node struct {
+			Id   string
 			Name string
 		}
 	}
@@ -215,19 +425,18 @@ func (u *User) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 			Repositories repositoriesQuery `graphql:"repositories(ownerAffiliations: OWNER, first: 100)"`
 		} `graphql:"user(login: $login)"`
 	}
-	err := client.Query("GetUserRepositories", &iq, map[string]interface{}{
+	err := runQuery(ctx, "GetUserRepositories", &iq, map[string]interface{}{
 		"login": graphql.String(u.Login)})
 	if err != nil {
-		log.Println(err)
 		return nil, err
 	}
 
 	e := make([]fuse.Dirent, len(iq.User.Repositories.Edges))
 	for i, r := range iq.User.Repositories.Edges {
 		e[i] = fuse.Dirent{
-			// TODO: Inode: r.Node.Id,
-			Type: fuse.DT_Dir,
-			Name: r.Node.Name,
+			Inode: inode(r.Node.Id),
+			Type:  fuse.DT_Dir,
+			Name:  r.Node.Name,
 		}
 	}
 
@@ -239,38 +448,128 @@ func (u *User) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	sq.User.Repositories = iq.User.Repositories
 
 	for sq.User.Repositories.PageInfo.HasNextPage {
-		err := client.Query("GetUserRepositories", &sq,
+		err := runQuery(ctx, "GetUserRepositories", &sq,
 			map[string]interface{}{
 				"after": graphql.String(sq.User.Repositories.PageInfo.EndCursor),
 				"login": graphql.String(u.Login),
 			})
 		if err != nil {
-			log.Println(err)
 			return nil, err
 		}
 
 		ne := make([]fuse.Dirent, len(sq.User.Repositories.Edges))
 		for i, r := range sq.User.Repositories.Edges {
 			ne[i] = fuse.Dirent{
-				// TODO: Inode: r.Node.Id,
-				Type: fuse.DT_Dir,
-				Name: r.Node.Name,
+				Inode: inode(r.Node.Id),
+				Type:  fuse.DT_Dir,
+				Name:  r.Node.Name,
 			}
 		}
 		e = append(e, ne...)
 	}
 
+	rememberRepoNames(u.Login, e)
 	return e, nil
 }
 
-// Repo implements fs.Node, fs.NodeStringLookuper, and HandleReadDirAller for
-// a repository, which contains the entries at the root of that repository.
+// Org implements fs.Node, fs.NodeRequestLookuper, and HandleReadDirAller for
+// an organization directory, which contains the organization's repositories.
+// Like User, it also implements fs.NodeMkdirer, fs.NodeRemover, and
+// fs.NodeRenamer, if the authenticated user administers the organization.
+type Org struct {
+	// Id is the organization's github node id.
+	Id string
+	// Login is the organization's github login, which is unique.
+	Login string
+	// ViewerCanAdminister is whether the authenticated user is an
+	// administrator of this organization.
+	ViewerCanAdminister bool
+}
+
+func (o *Org) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Valid = cli.OwnerTTL
+	a.Inode = inode(o.Id)
+	// Org can only be written if repositories can be created and deleted in
+	// it
+	if o.manageable() {
+		setMode(a, os.ModeDir|0o700)
+	} else {
+		setMode(a, os.ModeDir|0o500)
+	}
+
+	// TODO: set other equivalent information
+
+	return nil
+}
+
+func (o *Org) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	resp.EntryValid = cli.RepoTTL
+	return lookupRepoDir(ctx, o.Login, req.Name)
+}
+
+func (o *Org) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	var iq struct {
+		Organization struct {
+			Repositories repositoriesQuery `graphql:"repositories(first: 100)"`
+		} `graphql:"organization(login: $login)"`
+	}
+	err := runQuery(ctx, "GetOrganizationRepositories", &iq,
+		map[string]interface{}{"login": graphql.String(o.Login)})
+	if err != nil {
+		return nil, err
+	}
+
+	e := make([]fuse.Dirent, len(iq.Organization.Repositories.Edges))
+	for i, r := range iq.Organization.Repositories.Edges {
+		e[i] = fuse.Dirent{
+			Inode: inode(r.Node.Id),
+			Type:  fuse.DT_Dir,
+			Name:  r.Node.Name,
+		}
+	}
+
+	var sq struct {
+		Organization struct {
+			Repositories repositoriesQuery `graphql:"repositories(first: 100, after: $after)"`
+		} `graphql:"organization(login: $login)"`
+	}
+	sq.Organization.Repositories = iq.Organization.Repositories
+
+	for sq.Organization.Repositories.PageInfo.HasNextPage {
+		err := runQuery(ctx, "GetOrganizationRepositories", &sq,
+			map[string]interface{}{
+				"after": graphql.String(sq.Organization.Repositories.PageInfo.EndCursor),
+				"login": graphql.String(o.Login),
+			})
+		if err != nil {
+			return nil, err
+		}
+
+		ne := make([]fuse.Dirent, len(sq.Organization.Repositories.Edges))
+		for i, r := range sq.Organization.Repositories.Edges {
+			ne[i] = fuse.Dirent{
+				Inode: inode(r.Node.Id),
+				Type:  fuse.DT_Dir,
+				Name:  r.Node.Name,
+			}
+		}
+		e = append(e, ne...)
+	}
+
+	rememberRepoNames(o.Login, e)
+	return e, nil
+}
+
+// Repo is a snapshot of a repository's metadata, which pins the repository's
+// default branch to a specific commit. Repos are never modified, so all of the
+// nodes created from one see the same commit.
 type Repo struct {
+	// Id is the repository's github node id.
+	Id string
 	// Name is the repository's name.
 	Name string
 	// Owner is the owner of this repository.
 	Owner struct{ Login string }
-	// TODO: handle repo and user inode collisions
 
 	// PushedAt is the time the repository was last pushed to. This is used as
 	// the mtime.
@@ -279,71 +578,149 @@ type Repo struct {
 	// the ctime.
 	UpdatedAt time.Time
 
-	// DefaultBranchRef is the main branch for this repository.
-	DefaultBranchRef struct{ Name string }
+	// DefaultBranchRef is the main branch for this repository, and the commit
+	// it pointed to when this snapshot was taken.
+	DefaultBranchRef struct {
+		Name   string
+		Target refTarget
+	}
 }
 
-func (r *Repo) Attr(ctx context.Context, a *fuse.Attr) error {
-	// TODO: a.Inode = r.Id
-	// Repo can be read but not written
-	a.Mode = os.ModeDir | 0o044
-	a.Mtime = r.PushedAt
-	a.Ctime = r.UpdatedAt
-
-	// TODO: set other equivalent information
+// root returns the root directory of the repository's default branch, at the
+// commit it is pinned to.
+func (r *Repo) root() *Dir {
+	oid, tree := r.DefaultBranchRef.Target.commit()
+	if oid == "" {
+		// The repository is empty
+		return &Dir{Path: "", Rev: r.DefaultBranchRef.Name, repo: r}
+	}
 
-	return nil
+	return &Dir{Path: "", Rev: oid, Oid: tree, repo: r}
 }
 
-func (r *Repo) Lookup(ctx context.Context, name string) (fs.Node, error) {
-	return (&Dir{Path: "", repo: r}).Lookup(ctx, name)
+// refTarget is the target of a ref, which is either a commit or an annotated
+// tag pointing to a commit.
+type refTarget struct {
+	Oid    string
+	Commit struct {
+		Tree struct{ Oid string }
+	} `graphql:"... on Commit"`
+	Tag struct {
+		Target struct {
+			Oid    string
+			Commit struct {
+				Tree struct{ Oid string }
+			} `graphql:"... on Commit"`
+		}
+	} `graphql:"... on Tag"`
 }
 
-func (r *Repo) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	return (&Dir{Path: "", repo: r}).ReadDirAll(ctx)
+// commit returns the ids of the commit that t refers to and its tree,
+// following annotated tags.
+func (t *refTarget) commit() (oid, tree string) {
+	if t.Tag.Target.Oid != "" {
+		return t.Tag.Target.Oid, t.Tag.Target.Commit.Tree.Oid
+	}
+	return t.Oid, t.Commit.Tree.Oid
 }
 
-// Content is the response to a github api repo/.../contents/... request.
-type Content struct {
-	// Type is the type of content this represents.
-	Type string
-	// Path is the relative path to this content from the repository root.
-	Path string
-	// Path is the basename of this content's path.
+// TreeEntry is an entry within a git tree.
+type TreeEntry struct {
+	// Name is the basename of this entry's path.
 	Name string
+	// Type is the type of the object this entry refers to, which is one of
+	// "blob", "tree", or "commit".
+	Type string
+	// Mode is the git file mode of this entry.
+	Mode int
+	// Oid is the id of the object this entry refers to. For submodules, this is
+	// the commit that the submodule is pinned at.
+	Oid string
+	// Object is the object this entry refers to. It is requested along with
+	// the entry so that the attributes of blobs are known without another
+	// query.
+	Object struct {
+		Blob struct {
+			ByteSize int
+			IsBinary bool
+		} `graphql:"... on Blob"`
+	}
+}
+
+// Git file modes, as found in tree entries.
+const (
+	modeExecutable = 0o100755
+	modeSymlink    = 0o120000
+)
+
+// inode returns the inode number of the node for e, which is within d.
+// Submodules are numbered like trees of d, since whether they are directories
+// or files isn't known until their urls are checked.
+func (e *TreeEntry) inode(d *Dir) uint64 {
+	path := filepath.Join(d.Path, e.Name)
+	switch e.Type {
+	case "blob":
+		return blobInode(d.repo, path, e.Oid)
+	case "tree", "commit":
+		return treeInode(d.repo, d.Rev, d.Via, path)
+	default:
+		return 0
+	}
 }
 
-func (c *Content) DirentType() fuse.DirentType {
-	// TODO: handle submodules (which show up as "file" in the current version
-	// of the api) and invalid types here
-	switch c.Type {
-	case "file":
+// DirentType returns the type of the node for e. Submodules are assumed to be
+// hosted on github, and therefore to be directories.
+func (e *TreeEntry) DirentType() fuse.DirentType {
+	switch e.Type {
+	case "blob":
+		if e.Mode == modeSymlink {
+			return fuse.DT_Link
+		}
 		return fuse.DT_File
-	case "dir":
+	case "tree", "commit":
 		return fuse.DT_Dir
-	case "symlink":
-		return fuse.DT_Link
 	default:
 		return fuse.DT_Unknown
 	}
 }
 
-// Dir implements fs.Node, fs.NodeStringLookuper, and HandleReadDirAller for
+// Dir implements fs.Node, fs.NodeRequestLookuper, and HandleReadDirAller for
 // a directory within a repository, which contains the entries within that
 // directory.
 type Dir struct {
 	// Path is the relative path to this directory from the repository root.
 	Path string
+	// Rev is the revision that this directory is being viewed at. This is the
+	// id of a commit, except within empty repositories.
+	Rev string
+	// Oid is the id of this directory's tree, if it is known.
+	Oid string
+	// Via identifies the ref or commit directory, or the submodule, that this
+	// directory was reached through, or is empty within the default branch.
+	// It only distinguishes the inode numbers of otherwise identical trees.
+	Via string
+	// Inode is the inode number of this directory if it is the root of a ref
+	// or submodule, whose number is chosen by the directory listing it, or
+	// zero to derive it from the tree.
+	Inode uint64
 	// Repo is the repository that this directory belongs to.
 	repo *Repo
 }
 
 func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
-	// TODO: a.Inode =
+	a.Valid = cli.ObjectTTL
+	a.Inode = d.Inode
+	if a.Inode == 0 {
+		a.Inode = treeInode(d.repo, d.Rev, d.Via, d.Path)
+	}
 	// Dir can be read but not written
-	a.Mode = os.ModeDir | 0o044
-	// TODO: determine the times for this specific sub-directory
-	a.Mtime = d.repo.PushedAt
+	setMode(a, os.ModeDir|0o500)
+	t, ok := mtime(ctx, d.repo, d.Rev, d.Path)
+	if !ok {
+		// The actual time is fetched once the kernel asks again
+		a.Valid = cli.RepoTTL
+	}
+	a.Mtime = t
 	a.Ctime = d.repo.UpdatedAt
 
 	// TODO: set other equivalent information
@@ -351,124 +728,186 @@ func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
 	return nil
 }
 
-func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
-	path := filepath.Join(d.Path, name)
-	// TODO: figure out how to differentiate between Tree and Blob without
-	// asking for extraneous data
-	var query struct {
-		Repository struct {
-			Object struct {
-				Tree struct {
-					AbbreviatedOid string
-				} `graphql:"... on Tree"`
-				Blob struct {
-					Oid string
-				} `graphql:"... on Blob"`
-			} `graphql:"object(expression: $expression)"`
-		} `graphql:"repository(name: $name, owner: $owner)"`
+func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	// The entries of a commit never change
+	resp.EntryValid = cli.ObjectTTL
+	if d.Path == "" && req.Name == danglingDirName {
+		return nil, syscall.ENOENT
 	}
-	err := client.Query("StatDirEntry", &query, map[string]interface{}{
-		"name":  graphql.String(d.repo.Name),
-		"owner": graphql.String(d.repo.Owner.Login),
-		"expression": graphql.String(fmt.Sprintf("%s:%s",
-			d.repo.DefaultBranchRef.Name, path)),
-	})
+
+	entries, err := d.entries(ctx)
 	if err != nil {
-		log.Println(err)
 		return nil, err
 	}
 
-	if query.Repository.Object.Tree.AbbreviatedOid != "" {
-		return &Dir{Path: path, repo: d.repo}, nil
-	} else if query.Repository.Object.Blob.Oid != "" {
-		return &File{Path: path, repo: d.repo}, nil
-	} else {
-		return nil, syscall.ENOENT
+	for _, entry := range entries {
+		if entry.Name == req.Name {
+			return d.node(ctx, entry)
+		}
 	}
+
+	return nil, syscall.ENOENT
 }
 
-func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+// node returns the node for entry, which must be one of the entries of d.
+func (d *Dir) node(ctx context.Context, entry TreeEntry) (fs.Node, error) {
+	path := filepath.Join(d.Path, entry.Name)
+	if entry.Type == "commit" {
+		submodules, err := d.submodules(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return submoduleNode(ctx, submodules[path], entry.Oid, d.repo,
+			entry.inode(d))
+	}
+
+	switch entry.DirentType() {
+	case fuse.DT_Dir:
+		return &Dir{Path: path, Rev: d.Rev, Oid: entry.Oid, Via: d.Via,
+			repo: d.repo}, nil
+	case fuse.DT_Link:
+		return &Symlink{Path: path, Rev: d.Rev, Oid: entry.Oid,
+			Size: entry.Object.Blob.ByteSize, repo: d.repo}, nil
+	default:
+		return &File{Path: path, Rev: d.Rev, Oid: entry.Oid,
+			Size:       entry.Object.Blob.ByteSize,
+			IsBinary:   entry.Object.Blob.IsBinary,
+			Executable: entry.Mode == modeExecutable, repo: d.repo}, nil
+	}
+}
+
+// listingTTL is how long directory listings are cached in memory for. Since
+// directories are viewed at pinned commits, listings never become stale, so
+// this only limits how long they occupy memory.
+const listingTTL = 10 * time.Minute
+
+// listings caches the entries of trees, so that a listing followed by lookups
+// and stats of the listed entries only costs a single query.
+var listings = newCache[pathKey, []TreeEntry](listingTTL)
+
+// entries returns the entries of the tree that d represents.
+func (d *Dir) entries(ctx context.Context) ([]TreeEntry, error) {
+	key := pathKey{d.repo.Owner.Login, d.repo.Name, d.Rev, d.Path}
+	if entries, ok := listings.get(key); ok {
+		return entries, nil
+	}
+
+	var entries []TreeEntry
+	if objects.getJSON(treesKind, d.Oid, &entries) {
+		listings.set(key, entries)
+		d.remember(entries)
+		return entries, nil
+	}
+
 	var query struct {
 		Repository struct {
 			Object struct {
 				Tree struct {
-					Entries []struct {
-						Name string
-						Type string
-					}
+					Oid     string
+					Entries []TreeEntry
 				} `graphql:"... on Tree"`
 			} `graphql:"object(expression: $expression)"`
 		} `graphql:"repository(name: $name, owner: $owner)"`
 	}
-	err := client.Query("ListDir", &query, map[string]interface{}{
+	err := runQuery(ctx, "ListDir", &query, map[string]interface{}{
 		"name":  graphql.String(d.repo.Name),
 		"owner": graphql.String(d.repo.Owner.Login),
 		"expression": graphql.String(fmt.Sprintf("%s:%s",
-			d.repo.DefaultBranchRef.Name, d.Path)),
+			d.Rev, d.Path)),
 	})
 	if err != nil {
-		log.Println(err)
 		return nil, err
 	}
 
-	e := make([]fuse.Dirent, len(query.Repository.Object.Tree.Entries))
-	for i, entry := range query.Repository.Object.Tree.Entries {
-		// TODO: figure out symlinks and submodules here
-		var t fuse.DirentType
-		switch entry.Type {
-		case "blob":
-			t = fuse.DT_File
-		case "tree":
-			t = fuse.DT_Dir
+	tree := query.Repository.Object.Tree
+	objects.putJSON(treesKind, tree.Oid, tree.Entries)
+	listings.set(key, tree.Entries)
+	d.remember(tree.Entries)
+	return tree.Entries, nil
+}
+
+// remember records the paths of entries, which must be d's entries, so that
+// their mtimes are fetched together whether they are listed or looked up.
+func (d *Dir) remember(entries []TreeEntry) {
+	paths := make([]string, len(entries))
+	for i, entry := range entries {
+		paths[i] = filepath.Join(d.Path, entry.Name)
+	}
+	rememberSiblings(d.repo, d.Rev, d.Path, paths)
+}
+
+func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	entries, err := d.entries(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var submodules map[string]string
+
+	e := make([]fuse.Dirent, len(entries))
+	for i, entry := range entries {
+		t := entry.DirentType()
+
+		// Submodules that aren't hosted on github are displayed as files, which
+		// can only be determined by checking their url
+		if entry.Type == "commit" {
+			if submodules == nil {
+				submodules, err = d.submodules(ctx)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			url := submodules[filepath.Join(d.Path, entry.Name)]
+			if _, _, ok := parseGitHubURL(url, d.repo); !ok {
+				t = fuse.DT_File
+			}
 		}
 
 		e[i] = fuse.Dirent{
-			// TODO: Inode: 0,
-			Type: t,
-			Name: entry.Name,
+			Inode: entry.inode(d),
+			Type:  t,
+			Name:  entry.Name,
 		}
 	}
 	return e, nil
 }
 
-// File implements fs.Node and fs.HandleReadAller for a file within a
-// repository.
+// File implements fs.Node and fs.NodeOpener for a file within a repository.
 type File struct {
 	// Path is the relative path to this file from the repository root.
 	Path string
+	// Rev is the id of the commit that this file is being viewed at.
+	Rev string
+	// Oid is the id of this file's blob.
+	Oid string
+	// Size is the size of this file in bytes.
+	Size int
+	// IsBinary is whether this file's contents were determined to be binary.
+	IsBinary bool
+	// Executable is whether this file has the executable bit set in git.
+	Executable bool
 	// Repo is the repository that this file belongs to.
 	repo *Repo
 }
 
 func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
-	var query struct {
-		Repository struct {
-			Object struct {
-				Blob struct {
-					ByteSize int
-				} `graphql:"... on Blob"`
-			} `graphql:"object(expression: $expression)"`
-		} `graphql:"repository(name: $name, owner: $owner)"`
-	}
-	err := client.Query("GetFileByteSize", &query, map[string]interface{}{
-		"name":  graphql.String(f.repo.Name),
-		"owner": graphql.String(f.repo.Owner.Login),
-		"expression": graphql.String(fmt.Sprintf("%s:%s",
-			f.repo.DefaultBranchRef.Name, f.Path)),
-	})
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-	log.Println(f)
-	log.Println(query)
-
-	// TODO: a.Inode =
+	a.Valid = cli.ObjectTTL
+	a.Inode = blobInode(f.repo, f.Path, f.Oid)
 	// File can be read but not written
-	a.Mode = 0o044
-	a.Size = uint64(query.Repository.Object.Blob.ByteSize)
-	// TODO: determine the times for this specific file
-	a.Mtime = f.repo.PushedAt
+	var mode os.FileMode = 0o400
+	if f.Executable {
+		mode |= 0o100
+	}
+	setMode(a, mode)
+	a.Size = uint64(f.Size)
+	t, ok := mtime(ctx, f.repo, f.Rev, f.Path)
+	if !ok {
+		// The actual time is fetched once the kernel asks again
+		a.Valid = cli.RepoTTL
+	}
+	a.Mtime = t
 	a.Ctime = f.repo.UpdatedAt
 
 	// TODO: set other equivalent information
@@ -476,27 +915,56 @@ func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
 	return nil
 }
 
-func (f *File) ReadAll(ctx context.Context) ([]byte, error) {
-	// TODO: handle binary and truncated files
+func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if b, ok := objects.get(blobsKind, f.Oid); ok {
+		return fileData(b), nil
+	}
+
+	// The text of binary blobs is always null, so their exact contents have to
+	// be fetched separately
+	if f.IsBinary {
+		return newBlobStream(f.repo, f.Oid, f.Size), nil
+	}
+
 	var query struct {
 		Repository struct {
 			Object struct {
 				Blob struct {
-					Text string
+					IsBinary    bool
+					IsTruncated bool
+					Text        string
 				} `graphql:"... on Blob"`
 			} `graphql:"object(expression: $expression)"`
 		} `graphql:"repository(name: $name, owner: $owner)"`
 	}
-	err := client.Query("GetFileContents", &query, map[string]interface{}{
+	err := runQuery(ctx, "GetFileContents", &query, map[string]interface{}{
 		"name":  graphql.String(f.repo.Name),
 		"owner": graphql.String(f.repo.Owner.Login),
 		"expression": graphql.String(fmt.Sprintf("%s:%s",
-			f.repo.DefaultBranchRef.Name, f.Path)),
+			f.Rev, f.Path)),
 	})
 	if err != nil {
-		log.Println(err)
 		return nil, err
 	}
 
-	return []byte(query.Repository.Object.Blob.Text), nil
+	// The text of large blobs is truncated, so their exact contents also have
+	// to be fetched separately. Blobs can also turn out to be binary here if
+	// their entries were prefetched, since the REST api doesn't report that.
+	// Finally, graphql strings are always UTF-8, so the text of blobs in other
+	// encodings differs from their contents, which is noticed by its size.
+	blob := query.Repository.Object.Blob
+	if blob.IsBinary || blob.IsTruncated || len(blob.Text) != f.Size {
+		return newBlobStream(f.repo, f.Oid, f.Size), nil
+	}
+
+	objects.put(blobsKind, f.Oid, []byte(blob.Text))
+	return fileData(blob.Text), nil
+}
+
+// fileData implements fs.HandleReadAller for a file whose contents have
+// already been fetched.
+type fileData []byte
+
+func (d fileData) ReadAll(ctx context.Context) ([]byte, error) {
+	return d, nil
 }
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// confirmDeleteXattr is the extended attribute that must be set on the
+// directory of a repository that isn't empty before it can be deleted.
+const confirmDeleteXattr = "user.gh-fs.confirm-delete"
+
+// CreateRepositoryInput is the input of the createRepository mutation. Its
+// name is used as the type of the mutation's variable, so it must match the
+// schema.
+type CreateRepositoryInput struct {
+	Name       string `json:"name"`
+	Visibility string `json:"visibility"`
+	OwnerId    string `json:"ownerId,omitempty"`
+}
+
+// UpdateRepositoryInput is the input of the updateRepository mutation. Its
+// name is used as the type of the mutation's variable, so it must match the
+// schema.
+type UpdateRepositoryInput struct {
+	RepositoryId string `json:"repositoryId"`
+	Name         string `json:"name"`
+}
+
+// manageable reports whether repositories can be created, deleted, and
+// renamed in u.
+func (u *User) manageable() bool {
+	return cli.AllowRepoManagement && u.IsViewer
+}
+
+// manageable reports whether repositories can be created, deleted, and
+// renamed in o.
+func (o *Org) manageable() bool {
+	return cli.AllowRepoManagement && o.ViewerCanAdminister
+}
+
+func (u *User) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	if !u.manageable() {
+		return nil, syscall.EROFS
+	}
+	if !fromOwner(req.Header) {
+		return nil, syscall.EACCES
+	}
+
+	// The owner defaults to the authenticated user
+	return createRepo(ctx, "", req.Name)
+}
+
+func (u *User) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if !u.manageable() {
+		return syscall.EROFS
+	}
+	if !fromOwner(req.Header) {
+		return syscall.EACCES
+	}
+
+	return deleteRepo(ctx, u.Login, req)
+}
+
+func (o *Org) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	if !o.manageable() {
+		return nil, syscall.EROFS
+	}
+	if !fromOwner(req.Header) {
+		return nil, syscall.EACCES
+	}
+
+	return createRepo(ctx, o.Id, req.Name)
+}
+
+func (o *Org) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if !o.manageable() {
+		return syscall.EROFS
+	}
+	if !fromOwner(req.Header) {
+		return syscall.EACCES
+	}
+
+	return deleteRepo(ctx, o.Login, req)
+}
+
+func (u *User) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	if !u.manageable() {
+		return syscall.EROFS
+	}
+	if !fromOwner(req.Header) {
+		return syscall.EACCES
+	}
+
+	return renameRepo(ctx, u, u.Login, req, newDir)
+}
+
+func (o *Org) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	if !o.manageable() {
+		return syscall.EROFS
+	}
+	if !fromOwner(req.Header) {
+		return syscall.EACCES
+	}
+
+	return renameRepo(ctx, o, o.Login, req, newDir)
+}
+
+// createRepo creates a private repository with the given name, owned by the
+// owner with the given id, and returns its directory.
+func createRepo(ctx context.Context, ownerId, name string) (*RepoDir, error) {
+	if !validRepoName(name) {
+		return nil, syscall.EINVAL
+	}
+
+	var mutation struct {
+		CreateRepository struct {
+			Repository Repo
+		} `graphql:"createRepository(input: $input)"`
+	}
+	err := runMutation(ctx, "CreateRepository", &mutation,
+		map[string]interface{}{"input": CreateRepositoryInput{
+			Name:       name,
+			Visibility: "PRIVATE",
+			OwnerId:    ownerId,
+		}})
+	if err != nil {
+		return nil, err
+	}
+
+	r := &mutation.CreateRepository.Repository
+	forgetMissingRepo(r.Owner.Login, r.Name)
+	return registerRepoDir(r), nil
+}
+
+// deleteRepo deletes the repository that req removes from the directory of
+// owner. Since this can't be undone, the repository must either be empty, or
+// have confirmDeleteXattr set on its directory.
+func deleteRepo(ctx context.Context, owner string, req *fuse.RemoveRequest) error {
+	if !req.Dir {
+		return syscall.EISDIR
+	}
+
+	d, err := lookupRepoDir(ctx, owner, req.Name)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	confirmed := d.confirmDelete != nil
+	d.mu.Unlock()
+
+	if !confirmed {
+		// The snapshot may predate the first push, so whether the repository
+		// is empty has to be checked again
+		if err := d.refresh(ctx); err != nil {
+			return err
+		}
+
+		d.mu.Lock()
+		head, _ := d.repo.DefaultBranchRef.Target.commit()
+		d.mu.Unlock()
+		if head != "" {
+			return syscall.ENOTEMPTY
+		}
+	}
+
+	owner, name, ok := d.ownerAndName()
+	if !ok {
+		return syscall.ENOENT
+	}
+
+	err = restClient.DoWithContext(ctx, http.MethodDelete,
+		fmt.Sprintf("repos/%s/%s", url.PathEscape(owner),
+			url.PathEscape(name)), nil, nil)
+	if err != nil {
+		log.Println(err)
+		return errno(err)
+	}
+
+	d.mu.Lock()
+	d.gone = true
+	d.mu.Unlock()
+
+	unregisterRepoDir(owner, name)
+	repoNames.delete(strings.ToLower(owner))
+	miss(strings.ToLower(owner + "/" + name))
+	return nil
+}
+
+func (d *RepoDir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if req.Name != confirmDeleteXattr || d.confirmDelete == nil {
+		return fuse.ErrNoXattr
+	}
+
+	resp.Xattr = append(resp.Xattr, d.confirmDelete...)
+	return nil
+}
+
+func (d *RepoDir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.confirmDelete != nil {
+		resp.Append(confirmDeleteXattr)
+	}
+	return nil
+}
+
+// Setxattr only supports confirmDeleteXattr, which is kept in memory, so it
+// has to be set again after remounting.
+func (d *RepoDir) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	if !cli.AllowRepoManagement {
+		return syscall.EROFS
+	}
+	if !fromOwner(req.Header) {
+		return syscall.EACCES
+	}
+	if req.Name != confirmDeleteXattr {
+		return syscall.ENOTSUP
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.confirmDelete = append([]byte{}, req.Xattr...)
+	return nil
+}
+
+func (d *RepoDir) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	if !fromOwner(req.Header) {
+		return syscall.EACCES
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if req.Name != confirmDeleteXattr || d.confirmDelete == nil {
+		return fuse.ErrNoXattr
+	}
+
+	d.confirmDelete = nil
+	return nil
+}
+
+// renameRepo renames the repository that req renames from dir, the directory
+// of owner, to newDir. If newDir is the directory of another owner, the
+// repository is transferred to them instead.
+func renameRepo(ctx context.Context, dir fs.Node, owner string, req *fuse.RenameRequest, newDir fs.Node) error {
+	var newOwner string
+	switch newDir := newDir.(type) {
+	case *User:
+		newOwner = newDir.Login
+	case *Org:
+		newOwner = newDir.Login
+	default:
+		return syscall.EXDEV
+	}
+	if !validRepoName(req.NewName) {
+		return syscall.EINVAL
+	}
+
+	d, err := lookupRepoDir(ctx, owner, req.OldName)
+	if err != nil {
+		return err
+	}
+	r, err := d.snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	oldOwner, oldName := r.Owner.Login, r.Name
+	oldKey := strings.ToLower(oldOwner + "/" + oldName)
+	newKey := strings.ToLower(newOwner + "/" + req.NewName)
+
+	// The kernel keeps using d for the repository's new entry, so d is
+	// updated in place when the repository is renamed, and stops resolving
+	// when it is transferred
+	if strings.EqualFold(newOwner, owner) {
+		if req.NewName == oldName {
+			return nil
+		}
+
+		var mutation struct {
+			UpdateRepository struct {
+				Repository Repo
+			} `graphql:"updateRepository(input: $input)"`
+		}
+		err := runMutation(ctx, "UpdateRepository", &mutation,
+			map[string]interface{}{"input": UpdateRepositoryInput{
+				RepositoryId: r.Id,
+				Name:         req.NewName,
+			}})
+		if err != nil {
+			return err
+		}
+
+		renamed := &mutation.UpdateRepository.Repository
+		repoDirs.Lock()
+		delete(repoDirs.m, oldKey)
+		repoDirs.m[newKey] = d
+		d.mu.Lock()
+		d.owner, d.name = renamed.Owner.Login, renamed.Name
+		d.replace(renamed)
+		d.mu.Unlock()
+		repoDirs.Unlock()
+	} else {
+		// Transfers complete asynchronously, so the repository can't be
+		// looked up at its new owner yet
+		body, err := json.Marshal(map[string]string{
+			"new_owner": newOwner,
+			"new_name":  req.NewName,
+		})
+		if err != nil {
+			return err
+		}
+
+		err = restClient.DoWithContext(ctx, http.MethodPost,
+			fmt.Sprintf("repos/%s/%s/transfer", url.PathEscape(oldOwner),
+				url.PathEscape(oldName)), bytes.NewReader(body), nil)
+		if err != nil {
+			log.Println(err)
+			return errno(err)
+		}
+
+		d.mu.Lock()
+		d.gone = true
+		d.mu.Unlock()
+		unregisterRepoDir(oldOwner, oldName)
+	}
+
+	repoNames.delete(strings.ToLower(oldOwner))
+	forgetMissingRepo(newOwner, req.NewName)
+	if oldKey != newKey {
+		miss(oldKey)
+	}
+
+	// The kernel holds locks on both directories until the rename has been
+	// replied to, so the entries can't be invalidated synchronously
+	go func() {
+		invalidateEntry(dir, req.OldName)
+		invalidateEntry(newDir, req.NewName)
+	}()
+	return nil
+}
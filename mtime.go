@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	graphql "github.com/cli/shurcooL-graphql"
+)
+
+// mtimeBatchSize is the maximum number of paths whose modification times are
+// requested in a single query.
+const mtimeBatchSize = 50
+
+// pathKey identifies a path within a repository at a specific revision.
+type pathKey struct {
+	owner, name, rev, path string
+}
+
+// mtimeTTL is how long modification times, and the siblings of paths whose
+// times haven't been fetched yet, are cached in memory for. Since paths are
+// viewed at pinned commits, their times never change, so this only limits how
+// long they occupy memory.
+const mtimeTTL = 10 * time.Minute
+
+// mtimes caches the modification times of paths, which are the committed
+// dates of the last commits to touch them. Since the kernel stats entries one
+// at a time, the names of the entries of listed directories are remembered so
+// that the times of all of a path's siblings can be requested together.
+var mtimes = struct {
+	// Mutex is held while siblings are being taken from or put back into
+	// siblings, so that they are only fetched once.
+	sync.Mutex
+	// times contains the modification times that have been fetched.
+	times *cache[pathKey, time.Time]
+	// siblings contains, keyed by directory, the paths of entries within
+	// fetched directories whose times haven't been fetched yet.
+	siblings *cache[pathKey, []string]
+}{
+	times:    newCache[pathKey, time.Time](mtimeTTL),
+	siblings: newCache[pathKey, []string](mtimeTTL),
+}
+
+// rememberSiblings records the paths of the entries within dir, so that their
+// modification times can be fetched together once one of them is needed.
+func rememberSiblings(r *Repo, rev, dir string, paths []string) {
+	mtimes.Lock()
+	defer mtimes.Unlock()
+	mtimes.siblings.set(pathKey{r.Owner.Login, r.Name, rev, dir}, paths)
+}
+
+// mtime returns the committed date of the last commit before rev to touch p
+// in r. Modification times are only cosmetic, so if it can't be fetched, r's
+// push time is returned instead, and ok is false.
+func mtime(ctx context.Context, r *Repo, rev, p string) (t time.Time, ok bool) {
+	key := pathKey{r.Owner.Login, r.Name, rev, p}
+
+	mtimes.Lock()
+	if t, ok := mtimes.times.get(key); ok {
+		mtimes.Unlock()
+		return t, true
+	}
+
+	dirKey := key
+	dirKey.path = filepath.Dir(p)
+	if dirKey.path == "." {
+		dirKey.path = ""
+	}
+
+	batch := []string{p}
+	var rest []string
+	siblings, _ := mtimes.siblings.get(dirKey)
+	for _, s := range siblings {
+		sKey := key
+		sKey.path = s
+		if _, ok := mtimes.times.get(sKey); ok || s == p {
+			continue
+		}
+
+		if len(batch) < mtimeBatchSize {
+			batch = append(batch, s)
+		} else {
+			rest = append(rest, s)
+		}
+	}
+	if len(rest) > 0 {
+		mtimes.siblings.set(dirKey, rest)
+	} else {
+		mtimes.siblings.delete(dirKey)
+	}
+	mtimes.Unlock()
+
+	times, err := fetchMtimes(ctx, r, rev, batch)
+	if err != nil {
+		// The siblings are put back, so that they can still be batched with
+		// the next request if this one was interrupted
+		mtimes.Lock()
+		siblings, _ := mtimes.siblings.get(dirKey)
+		mtimes.siblings.set(dirKey, append(siblings, batch[1:]...))
+		mtimes.Unlock()
+
+		// The error has already been logged by runRawQuery
+		return r.PushedAt, false
+	}
+
+	for i, t := range times {
+		sKey := key
+		sKey.path = batch[i]
+		mtimes.times.set(sKey, t)
+	}
+	return times[0], true
+}
+
+// fetchMtimes returns the committed dates of the last commits before rev to
+// touch each of paths in r, in a single query. An empty path refers to the
+// root of the repository. Paths that no commit has touched are given r's push
+// time.
+func fetchMtimes(ctx context.Context, r *Repo, rev string, paths []string) ([]time.Time, error) {
+	// The number of paths varies, so the query is built by hand with an
+	// aliased history field for each path
+	var params, fields strings.Builder
+	variables := map[string]interface{}{
+		"name":  graphql.String(r.Name),
+		"owner": graphql.String(r.Owner.Login),
+		"rev":   graphql.String(rev),
+	}
+	for i, p := range paths {
+		if p == "" {
+			fmt.Fprintf(&fields,
+				"h%d: history(first: 1) { nodes { committedDate } }\n", i)
+			continue
+		}
+
+		fmt.Fprintf(&params, ", $p%d: String!", i)
+		fmt.Fprintf(&fields,
+			"h%d: history(path: $p%d, first: 1) { nodes { committedDate } }\n",
+			i, i)
+		variables[fmt.Sprintf("p%d", i)] = p
+	}
+	query := fmt.Sprintf(`query GetMtimes($name: String!, $owner: String!, $rev: String!%s) {
+	repository(name: $name, owner: $owner) {
+		object(expression: $rev) {
+			... on Commit {
+				%s
+			}
+		}
+	}
+}`, params.String(), fields.String())
+
+	var response struct {
+		Repository struct {
+			Object map[string]struct {
+				Nodes []struct {
+					CommittedDate time.Time
+				}
+			}
+		}
+	}
+	err := runRawQuery(ctx, "GetMtimes", query, variables, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	times := make([]time.Time, len(paths))
+	for i := range paths {
+		h := response.Repository.Object[fmt.Sprintf("h%d", i)]
+		if len(h.Nodes) > 0 {
+			times[i] = h.Nodes[0].CommittedDate
+		} else {
+			times[i] = r.PushedAt
+		}
+	}
+	return times, nil
+}
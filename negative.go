@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+
+	"bazil.org/fuse"
+)
+
+// misses contains paths that were recently looked up and found not to exist,
+// relative to the mount point and with owner and repository names lowercased,
+// so that programs probing for the same paths over and over again don't each
+// cost an api request. Entries expire after --negative-ttl.
+var misses *cache[string, struct{}]
+
+// repoNames contains the lowercase names of the repositories of each owner
+// whose directory has been listed, keyed by the owner's lowercase login, so
+// that lookups of repositories that aren't among them can be answered without
+// an api request. Entries expire after --negative-ttl.
+var repoNames *cache[string, map[string]bool]
+
+// missed reports whether p was recently found not to exist.
+func missed(p string) bool {
+	if cli.NegativeTTL == 0 {
+		return false
+	}
+
+	_, ok := misses.get(p)
+	return ok
+}
+
+// miss records that p was found not to exist.
+func miss(p string) {
+	if cli.NegativeTTL == 0 {
+		return
+	}
+
+	misses.set(p, struct{}{})
+}
+
+// forgetMissingRepo forgets anything suggesting that the repository with the
+// given owner and name doesn't exist, since it has just been created.
+func forgetMissingRepo(owner, name string) {
+	misses.delete(strings.ToLower(owner + "/" + name))
+	repoNames.delete(strings.ToLower(owner))
+}
+
+// ignored reports whether name is one of the names in --ignore, which are
+// never looked up as users, organizations, or repositories.
+func ignored(name string) bool {
+	for _, i := range cli.Ignore {
+		if strings.EqualFold(name, i) {
+			return true
+		}
+	}
+	return false
+}
+
+// validLogin reports whether name could be the login of a user or
+// organization, which may only contain alphanumeric characters and hyphens, or
+// also an underscore for enterprise managed users, whose logins are of the form
+// handle_shortcode.
+func validLogin(name string) bool {
+	for _, c := range name {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' ||
+			'0' <= c && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// validRepoName reports whether name could be the name of a repository, which
+// may only contain alphanumeric characters, hyphens, underscores, and periods.
+func validRepoName(name string) bool {
+	for _, c := range name {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' ||
+			'0' <= c && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return name != "" && name != "." && name != ".."
+}
+
+// knownMissingRepo reports whether the repository with the given owner and
+// name is known not to exist, without making any api requests.
+func knownMissingRepo(owner, name string) bool {
+	if !validRepoName(name) || ignored(name) {
+		return true
+	}
+
+	if cli.NegativeTTL != 0 {
+		if names, ok := repoNames.get(strings.ToLower(owner)); ok &&
+			!names[strings.ToLower(name)] {
+			return true
+		}
+	}
+
+	return missed(strings.ToLower(owner + "/" + name))
+}
+
+// rememberRepoNames records the names of all of owner's repositories, which
+// were just listed.
+func rememberRepoNames(owner string, e []fuse.Dirent) {
+	if cli.NegativeTTL == 0 {
+		return
+	}
+
+	names := make(map[string]bool, len(e))
+	for _, d := range e {
+		names[strings.ToLower(d.Name)] = true
+	}
+	repoNames.set(strings.ToLower(owner), names)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	graphql "github.com/cli/shurcooL-graphql"
+)
+
+// pollBatchSize is the maximum number of repositories checked for pushes in a
+// single query, which is the most that the nodes field accepts.
+const pollBatchSize = 100
+
+// pollRepos checks every repository that has been looked up for pushes to its
+// default branch once per interval, and refreshes those that have been pushed
+// to, so that they are re-pinned to the new commit, and the kernel forgets the
+// entries it has cached from the previous one.
+func pollRepos(interval time.Duration) {
+	for range time.Tick(interval) {
+		repoDirs.Lock()
+		dirs := make([]*RepoDir, 0, len(repoDirs.m))
+		for _, d := range repoDirs.m {
+			dirs = append(dirs, d)
+		}
+		repoDirs.Unlock()
+
+		for len(dirs) > pollBatchSize {
+			pollBatch(dirs[:pollBatchSize])
+			dirs = dirs[pollBatchSize:]
+		}
+		pollBatch(dirs)
+	}
+}
+
+// pollBatch checks each of dirs for pushes to its default branch in a single
+// query, and refreshes those that have been pushed to.
+func pollBatch(dirs []*RepoDir) {
+	ctx := context.Background()
+
+	ids := make([]graphql.ID, 0, len(dirs))
+	// byId contains each of dirs that has a snapshot, keyed by the id of its
+	// repository, and heads contains the commits those snapshots are pinned to
+	byId := map[string]*RepoDir{}
+	heads := map[string]string{}
+	for _, d := range dirs {
+		d.mu.Lock()
+		r := d.repo
+		d.mu.Unlock()
+		if r == nil {
+			continue
+		}
+
+		ids = append(ids, graphql.ID(r.Id))
+		byId[r.Id] = d
+		heads[r.Id], _ = r.DefaultBranchRef.Target.commit()
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	var query struct {
+		Nodes []struct {
+			Repository struct {
+				Id               string
+				DefaultBranchRef *struct {
+					Target struct{ Oid string }
+				}
+			} `graphql:"... on Repository"`
+		} `graphql:"nodes(ids: $ids)"`
+	}
+	err := runQuery(ctx, "PollRepos", &query,
+		map[string]interface{}{"ids": ids})
+	if err != nil {
+		return
+	}
+
+	for _, n := range query.Nodes {
+		d, ok := byId[n.Repository.Id]
+		if !ok {
+			continue
+		}
+
+		var head string
+		if n.Repository.DefaultBranchRef != nil {
+			head = n.Repository.DefaultBranchRef.Target.Oid
+		}
+
+		// Errors have already been logged by runQuery, and the current
+		// snapshot is kept if refreshing fails
+		if head != heads[n.Repository.Id] {
+			d.refresh(ctx)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+)
+
+// prefetchTree fetches the entries of every directory within root in a single
+// request, and caches them as if each directory had been listed. If the tree
+// is too large for github to return in full, nothing is cached, and
+// directories are listed individually as usual. An error is returned if the
+// tree couldn't be fetched.
+func prefetchTree(ctx context.Context, root *Dir) error {
+	r := root.repo
+	treeish := root.Oid
+	if treeish == "" {
+		treeish = root.Rev
+	}
+
+	var response struct {
+		Tree []struct {
+			Path string
+			Mode string
+			Type string
+			Sha  string
+			Size int
+		}
+		Truncated bool
+	}
+	err := restClient.DoWithContext(ctx, http.MethodGet, fmt.Sprintf("repos/%s/%s/git/trees/%s?recursive=1",
+		url.PathEscape(r.Owner.Login), url.PathEscape(r.Name),
+		url.PathEscape(treeish)), nil, &response)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	if response.Truncated {
+		return nil
+	}
+
+	// The response contains every path in a flat list, so the entries have to
+	// be grouped by directory
+	trees := map[string][]TreeEntry{"": nil}
+	oids := map[string]string{"": root.Oid}
+	for _, t := range response.Tree {
+		mode, err := strconv.ParseInt(t.Mode, 8, 32)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		dir := path.Dir(t.Path)
+		if dir == "." {
+			dir = ""
+		}
+
+		entry := TreeEntry{
+			Name: path.Base(t.Path),
+			Type: t.Type,
+			Mode: int(mode),
+			Oid:  t.Sha,
+		}
+		entry.Object.Blob.ByteSize = t.Size
+		trees[dir] = append(trees[dir], entry)
+
+		if t.Type == "tree" {
+			oids[t.Path] = t.Sha
+			if _, ok := trees[t.Path]; !ok {
+				trees[t.Path] = nil
+			}
+		}
+	}
+
+	for dir, entries := range trees {
+		if entries == nil {
+			entries = []TreeEntry{}
+		}
+
+		listings.set(pathKey{r.Owner.Login, r.Name, root.Rev, dir}, entries)
+		objects.putJSON(treesKind, oids[dir], entries)
+	}
+
+	return nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/cli/go-gh/pkg/api"
+)
+
+// Policies for requests made while the rate limit is exhausted.
+const (
+	// blockPolicy waits until the rate limit resets.
+	blockPolicy = "block"
+	// failPolicy fails immediately with EAGAIN.
+	failPolicy = "fail"
+)
+
+// maxRetries is the number of times a request that hit a rate limit is
+// retried before giving up.
+const maxRetries = 3
+
+// secondaryBackoff is how long to wait before the first retry of a request
+// that hit a secondary rate limit without saying when to retry. The wait is
+// doubled for each subsequent retry.
+const secondaryBackoff = 5 * time.Second
+
+// rateLimitError is returned for requests that weren't made because the rate
+// limit was exhausted.
+type rateLimitError struct {
+	// resource is the rate limit resource that was exhausted.
+	resource string
+	// reset is when the rate limit resets.
+	reset time.Time
+}
+
+func (e rateLimitError) Error() string {
+	return fmt.Sprintf("%s rate limit exhausted until %s", e.resource,
+		e.reset.Format(time.Kitchen))
+}
+
+func (rateLimitError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EAGAIN)
+}
+
+// rateLimit is the state of one of github's rate limit resources.
+type rateLimit struct {
+	remaining int
+	reset     time.Time
+}
+
+// scheduler is an http.RoundTripper that every api request is made through. It
+// caps the number of requests in flight, tracks the remaining rate limit of
+// each resource, handles exhausted rate limits according to the configured
+// policy, and retries requests that hit secondary rate limits with backoff.
+type scheduler struct {
+	base   http.RoundTripper
+	policy string
+	// slots holds a value for each request in flight.
+	slots chan struct{}
+
+	mu sync.Mutex
+	// limits contains the last known state of each rate limit resource.
+	limits map[string]rateLimit
+}
+
+func newScheduler(base http.RoundTripper, maxInFlight int, policy string) *scheduler {
+	return &scheduler{
+		base:   base,
+		policy: policy,
+		slots:  make(chan struct{}, maxInFlight),
+		limits: map[string]rateLimit{},
+	}
+}
+
+// sched is the scheduler used by all api clients.
+var sched *scheduler
+
+// resource returns the name of the rate limit resource that req counts
+// against.
+func resource(req *http.Request) string {
+	if strings.HasSuffix(req.URL.Path, "/graphql") {
+		return "graphql"
+	}
+	return "core"
+}
+
+// record updates the state of the given resource.
+func (s *scheduler) record(resource string, remaining int, reset time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits[resource] = rateLimit{remaining, reset}
+}
+
+// recordHeaders updates the state of the resource that resp counted against
+// from its headers, if it has them.
+func (s *scheduler) recordHeaders(resp *http.Response) {
+	remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+
+	r := resp.Header.Get("X-RateLimit-Resource")
+	if r == "" {
+		r = resource(resp.Request)
+	}
+	s.record(r, remaining, time.Unix(reset, 0))
+}
+
+// wait blocks until the given resource has requests remaining, or returns a
+// rateLimitError immediately if the policy is to fail.
+func (s *scheduler) wait(ctx context.Context, resource string) error {
+	s.mu.Lock()
+	l, ok := s.limits[resource]
+	s.mu.Unlock()
+
+	if !ok || l.remaining > 0 || time.Now().After(l.reset) {
+		return nil
+	}
+
+	if s.policy == failPolicy {
+		return rateLimitError{resource, l.reset}
+	}
+
+	log.Printf("%s rate limit exhausted, waiting until %s", resource,
+		l.reset.Format(time.Kitchen))
+	return sleep(ctx, time.Until(l.reset))
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// secondaryLimited reports whether resp indicates that a secondary rate limit
+// was hit, and if so, how long github asked to wait before retrying, which is
+// 0 if it didn't say.
+func secondaryLimited(resp *http.Response) (bool, time.Duration) {
+	if resp.StatusCode != http.StatusForbidden &&
+		resp.StatusCode != http.StatusTooManyRequests {
+		return false, 0
+	}
+
+	// Exhausting the primary rate limit also results in these status codes
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		return false, 0
+	}
+
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		return true, time.Duration(secs) * time.Second
+	}
+	return resp.StatusCode == http.StatusTooManyRequests, 0
+}
+
+func (s *scheduler) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	r := resource(req)
+	backoff := secondaryBackoff
+
+	for attempt := 0; ; attempt++ {
+		if err := s.wait(ctx, r); err != nil {
+			return nil, err
+		}
+
+		if attempt > 0 && req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+
+		select {
+		case s.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		resp, err := s.base.RoundTrip(req)
+		<-s.slots
+		if err != nil {
+			return nil, err
+		}
+
+		s.recordHeaders(resp)
+
+		// Requests can only be resent if their bodies can be recreated
+		retryable := attempt < maxRetries &&
+			(req.Body == nil || req.GetBody != nil)
+
+		limited, retryAfter := secondaryLimited(resp)
+		if limited && retryable {
+			resp.Body.Close()
+
+			if retryAfter == 0 {
+				retryAfter = backoff
+				backoff *= 2
+			}
+			log.Printf("secondary rate limit hit, retrying in %s", retryAfter)
+			if err := sleep(ctx, retryAfter); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// If the primary rate limit was exhausted, the request can be retried
+		// once it resets if the policy is to block
+		if (resp.StatusCode == http.StatusForbidden ||
+			resp.StatusCode == http.StatusTooManyRequests) &&
+			resp.Header.Get("X-RateLimit-Remaining") == "0" &&
+			s.policy == blockPolicy && retryable {
+			resp.Body.Close()
+			continue
+		}
+
+		// shurcooL-graphql reduces unsuccessful responses to a message, so
+		// they are turned into errors here, while their status and headers
+		// can still be used to classify them
+		if r == "graphql" && resp.StatusCode != http.StatusOK {
+			defer resp.Body.Close()
+			return nil, api.HandleHTTPError(resp)
+		}
+
+		return resp, nil
+	}
+}
+
+// seedRateLimit records the state of the GraphQL rate limit before any other
+// requests are made, so that an already exhausted rate limit is respected
+// from the start.
+func seedRateLimit() {
+	var query struct {
+		RateLimit struct {
+			Cost      int
+			Remaining int
+			ResetAt   time.Time
+		}
+	}
+	err := client.Query("GetRateLimit", &query, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	sched.record("graphql", query.RateLimit.Remaining, query.RateLimit.ResetAt)
+}
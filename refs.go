@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	graphql "github.com/cli/shurcooL-graphql"
+)
+
+const (
+	// refsDirName is the name of the hidden directory within each repository
+	// that contains that repository's refs.
+	refsDirName = ".refs"
+	// commitsDirName is the name of the hidden directory within each
+	// repository that contains that repository's commits.
+	commitsDirName = ".commits"
+)
+
+// Refs implements fs.Node, fs.NodeRequestLookuper, and HandleReadDirAller for
+// the .refs directory of a repository, which contains the heads and tags
+// directories.
+type Refs struct {
+	// Repo is the repository that these refs belong to.
+	repo *Repo
+}
+
+// refsPrefixes maps the names of the entries within Refs to the prefix of the
+// refs that they contain.
+var refsPrefixes = map[string]string{
+	"heads": "refs/heads/",
+	"tags":  "refs/tags/",
+}
+
+func (r *Refs) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Valid = cli.RepoTTL
+	a.Inode = inode(r.repo.Id, refsDirName)
+	// Refs can be read but not written
+	setMode(a, os.ModeDir|0o500)
+	a.Mtime = r.repo.PushedAt
+	a.Ctime = r.repo.UpdatedAt
+	return nil
+}
+
+func (r *Refs) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	resp.EntryValid = cli.ObjectTTL
+	prefix, ok := refsPrefixes[req.Name]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+
+	return &RefList{Prefix: prefix, repo: r.repo}, nil
+}
+
+func (r *Refs) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	e := make([]fuse.Dirent, 0, len(refsPrefixes))
+	for _, name := range []string{"heads", "tags"} {
+		e = append(e, fuse.Dirent{
+			Inode: refInode(r.repo, refsPrefixes[name]),
+			Type:  fuse.DT_Dir,
+			Name:  name,
+		})
+	}
+	return e, nil
+}
+
+// RefList implements fs.Node, fs.NodeRequestLookuper, and HandleReadDirAller
+// for a directory of refs sharing a common prefix. Since ref names can contain
+// slashes, a ref such as refs/heads/feature/x is found at heads/feature/x,
+// where heads/feature is another RefList. If --writable is provided, RefLists
+// of branches also implement fs.NodeMkdirer and fs.NodeRemover, which create
+// and delete branches.
+type RefList struct {
+	// Prefix is the fully qualified prefix shared by all refs within this
+	// directory, including the trailing slash, e.g. "refs/heads/".
+	Prefix string
+	// Repo is the repository that these refs belong to.
+	repo *Repo
+}
+
+func (l *RefList) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Valid = cli.RepoTTL
+	a.Inode = refInode(l.repo, l.Prefix)
+	if l.branches() {
+		setMode(a, os.ModeDir|0o700)
+	} else {
+		// RefList can be read but not written
+		setMode(a, os.ModeDir|0o500)
+	}
+	a.Mtime = l.repo.PushedAt
+	a.Ctime = l.repo.UpdatedAt
+	return nil
+}
+
+// key returns the key of the entry with the given name within l in misses.
+func (l *RefList) key(name string) string {
+	return strings.ToLower(l.repo.Owner.Login+"/"+l.repo.Name) + "/" +
+		refsDirName + "/" + strings.TrimPrefix(l.Prefix, "refs/") + name
+}
+
+func (l *RefList) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	// Refs can be moved at any time
+	resp.EntryValid = cli.RepoTTL
+
+	// No component of a ref name can begin with a period, so probes for files
+	// like .git can be answered locally
+	key := l.key(req.Name)
+	if strings.HasPrefix(req.Name, ".") || missed(key) {
+		return nil, syscall.ENOENT
+	}
+
+	var query struct {
+		Repository struct {
+			Ref *struct {
+				Target refTarget
+			} `graphql:"ref(qualifiedName: $qualifiedName)"`
+			Refs struct {
+				TotalCount int
+			} `graphql:"refs(refPrefix: $refPrefix, first: 1)"`
+		} `graphql:"repository(name: $name, owner: $owner)"`
+	}
+	err := runQuery(ctx, "LookupRef", &query, map[string]interface{}{
+		"name":          graphql.String(l.repo.Name),
+		"owner":         graphql.String(l.repo.Owner.Login),
+		"qualifiedName": graphql.String(l.Prefix + req.Name),
+		"refPrefix":     graphql.String(l.Prefix + req.Name + "/"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Refs are resolved to commits as they are looked up, so that everything
+	// found within them comes from the same commit
+	if query.Repository.Ref != nil {
+		oid, tree := query.Repository.Ref.Target.commit()
+		if l.branches() {
+			branch := strings.TrimPrefix(l.Prefix+req.Name, refsPrefixes["heads"])
+			return &BranchDir{ov: branchOverlay(l.repo, branch, oid, tree)}, nil
+		}
+		return &Dir{Path: "", Rev: oid, Oid: tree, Via: l.Prefix + req.Name,
+			Inode: refInode(l.repo, l.Prefix+req.Name), repo: l.repo}, nil
+	} else if query.Repository.Refs.TotalCount > 0 {
+		return &RefList{Prefix: l.Prefix + req.Name + "/", repo: l.repo}, nil
+	} else {
+		miss(key)
+		return nil, syscall.ENOENT
+	}
+}
+
+type refsQuery struct {
+	Edges []struct {
+		Node struct {
+			Name string
+		}
+	}
+	PageInfo struct {
+		EndCursor   string
+		HasNextPage bool
+	}
+}
+
+func (l *RefList) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	var iq struct {
+		Repository struct {
+			Refs refsQuery `graphql:"refs(refPrefix: $refPrefix, first: 100)"`
+		} `graphql:"repository(name: $name, owner: $owner)"`
+	}
+	err := runQuery(ctx, "GetRefs", &iq, map[string]interface{}{
+		"name":      graphql.String(l.repo.Name),
+		"owner":     graphql.String(l.repo.Owner.Login),
+		"refPrefix": graphql.String(l.Prefix),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Refs whose names contain slashes are collapsed into the first component
+	// of their name, which is a nested RefList.
+	seen := map[string]bool{}
+	var e []fuse.Dirent
+	add := func(q refsQuery) {
+		for _, r := range q.Edges {
+			name, _, _ := strings.Cut(r.Node.Name, "/")
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			e = append(e, fuse.Dirent{
+				Inode: refInode(l.repo, l.Prefix+name),
+				Type:  fuse.DT_Dir,
+				Name:  name,
+			})
+		}
+	}
+	add(iq.Repository.Refs)
+
+	var sq struct {
+		Repository struct {
+			Refs refsQuery `graphql:"refs(refPrefix: $refPrefix, first: 100, after: $after)"`
+		} `graphql:"repository(name: $name, owner: $owner)"`
+	}
+	sq.Repository.Refs = iq.Repository.Refs
+
+	for sq.Repository.Refs.PageInfo.HasNextPage {
+		err := runQuery(ctx, "GetRefs", &sq, map[string]interface{}{
+			"after":     graphql.String(sq.Repository.Refs.PageInfo.EndCursor),
+			"name":      graphql.String(l.repo.Name),
+			"owner":     graphql.String(l.repo.Owner.Login),
+			"refPrefix": graphql.String(l.Prefix),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		add(sq.Repository.Refs)
+	}
+
+	return e, nil
+}
+
+// Commits implements fs.Node, fs.NodeRequestLookuper, and HandleReadDirAller
+// for the .commits directory of a repository, which contains a directory for
+// each commit in the repository, named by its hash.
+type Commits struct {
+	// Repo is the repository that these commits belong to.
+	repo *Repo
+}
+
+func (c *Commits) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Valid = cli.RepoTTL
+	a.Inode = inode(c.repo.Id, commitsDirName)
+	// Commits can be read but not written
+	setMode(a, os.ModeDir|0o500)
+	a.Mtime = c.repo.PushedAt
+	a.Ctime = c.repo.UpdatedAt
+	return nil
+}
+
+// isHash reports whether name looks like a full or abbreviated commit hash.
+func isHash(name string) bool {
+	if len(name) < 4 || len(name) > 40 {
+		return false
+	}
+	for _, c := range name {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Commits) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	// The commit that a hash refers to never changes
+	resp.EntryValid = cli.ObjectTTL
+	// Only hashes are accepted, otherwise arbitrary expressions (like branch
+	// names or HEAD~2) would resolve to commits whose contents change over
+	// time.
+	key := strings.ToLower(c.repo.Owner.Login+"/"+c.repo.Name) + "/" +
+		commitsDirName + "/" + req.Name
+	if !isHash(req.Name) || missed(key) {
+		return nil, syscall.ENOENT
+	}
+
+	var query struct {
+		Repository struct {
+			Object struct {
+				Commit struct {
+					Oid  string
+					Tree struct{ Oid string }
+				} `graphql:"... on Commit"`
+			} `graphql:"object(expression: $expression)"`
+		} `graphql:"repository(name: $name, owner: $owner)"`
+	}
+	err := runQuery(ctx, "LookupCommit", &query, map[string]interface{}{
+		"name":       graphql.String(c.repo.Name),
+		"owner":      graphql.String(c.repo.Owner.Login),
+		"expression": graphql.String(req.Name),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	commit := query.Repository.Object.Commit
+	if commit.Oid == "" {
+		miss(key)
+		return nil, syscall.ENOENT
+	}
+
+	return &Dir{Path: "", Rev: commit.Oid, Oid: commit.Tree.Oid,
+		Via: commitsDirName + "/" + req.Name, repo: c.repo}, nil
+}
+
+// Commits conceptually contains every commit in the repository, but listing
+// them all would be far too expensive, so nothing is displayed. Commits can
+// still be accessed via lookup.
+func (c *Commits) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return nil, nil
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// refreshFileName is the name of the control file within each repository
+// directory that re-resolves the repository's default branch when written to.
+const refreshFileName = ".refresh"
+
+// repoDirs contains every RepoDir that has been looked up, keyed by their
+// lowercase owner and name, so that repeated lookups of the same repository
+// share a snapshot.
+var repoDirs = struct {
+	sync.Mutex
+	m map[string]*RepoDir
+}{m: map[string]*RepoDir{}}
+
+// repoDirIdleTTL is how long a RepoDir is kept in repoDirs after its snapshot
+// was last used. Once it has been forgotten, the repository is no longer
+// polled, and the next lookup of it starts from a new snapshot.
+const repoDirIdleTTL = time.Hour
+
+// sweepRepoDirs periodically forgets the RepoDirs whose snapshots haven't been
+// used for repoDirIdleTTL, so that every repository ever looked up doesn't
+// occupy memory, and get polled, for as long as the filesystem is mounted.
+func sweepRepoDirs() {
+	for range time.Tick(repoDirIdleTTL / 4) {
+		repoDirs.Lock()
+		for key, d := range repoDirs.m {
+			d.mu.Lock()
+			idle := time.Since(d.usedAt) > repoDirIdleTTL
+			d.mu.Unlock()
+
+			if idle {
+				delete(repoDirs.m, key)
+			}
+		}
+		repoDirs.Unlock()
+	}
+}
+
+// lookupRepoDir looks up the directory for the repository with the given
+// owner and name.
+func lookupRepoDir(ctx context.Context, owner, name string) (*RepoDir, error) {
+	key := strings.ToLower(owner + "/" + name)
+
+	repoDirs.Lock()
+	d, ok := repoDirs.m[key]
+	if !ok {
+		d = &RepoDir{owner: owner, name: name}
+	}
+	repoDirs.Unlock()
+
+	if !ok && knownMissingRepo(owner, name) {
+		return nil, syscall.ENOENT
+	}
+
+	if _, err := d.snapshot(ctx); err != nil {
+		if !ok && errors.Is(err, syscall.ENOENT) {
+			miss(key)
+		}
+		return nil, err
+	}
+
+	if !ok {
+		repoDirs.Lock()
+		if existing, ok := repoDirs.m[key]; ok {
+			d = existing
+		} else {
+			repoDirs.m[key] = d
+		}
+		repoDirs.Unlock()
+	}
+
+	return d, nil
+}
+
+// registerRepoDir returns the directory for the repository r, which has just
+// been created, with r as its snapshot.
+func registerRepoDir(r *Repo) *RepoDir {
+	key := strings.ToLower(r.Owner.Login + "/" + r.Name)
+
+	repoDirs.Lock()
+	defer repoDirs.Unlock()
+
+	d, ok := repoDirs.m[key]
+	if !ok {
+		d = &RepoDir{owner: r.Owner.Login, name: r.Name}
+		repoDirs.m[key] = d
+	}
+
+	d.mu.Lock()
+	d.replace(r)
+	d.usedAt = time.Now()
+	d.mu.Unlock()
+	return d
+}
+
+// unregisterRepoDir forgets the directory for the repository with the given
+// owner and name, which has just been deleted.
+func unregisterRepoDir(owner, name string) {
+	repoDirs.Lock()
+	delete(repoDirs.m, strings.ToLower(owner+"/"+name))
+	repoDirs.Unlock()
+}
+
+// RepoDir implements fs.Node, fs.NodeRequestLookuper, and HandleReadDirAller
+// for a repository, which contains the entries at the root of that
+// repository's default branch. Lookups within it are served from a snapshot of
+// the repository, which is only replaced once it is older than --snapshot-ttl
+// or the repository's .refresh file is written to, so everything found within
+// a repository comes from the same commit.
+type RepoDir struct {
+	mu sync.Mutex
+	// owner and name are the owner and name the repository was looked up by,
+	// or renamed to.
+	owner, name string
+	// gone is whether the repository has been deleted or transferred through
+	// d, after which the kernel may still hold on to d for a while.
+	gone bool
+	// repo is the current snapshot of the repository.
+	repo *Repo
+	// resolvedAt is when repo was taken.
+	resolvedAt time.Time
+	// usedAt is when repo was last used.
+	usedAt time.Time
+	// prefetched is the revision whose whole tree was last prefetched.
+	prefetched string
+	// confirmDelete is the value of the confirmDeleteXattr extended
+	// attribute, or nil if it isn't set.
+	confirmDelete []byte
+}
+
+// snapshot returns the current snapshot of d's repository, taking a new one if
+// there is none or it has expired.
+func (d *RepoDir) snapshot(ctx context.Context) (*Repo, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.usedAt = time.Now()
+	if d.gone {
+		return nil, syscall.ENOENT
+	}
+	if d.repo != nil &&
+		(cli.SnapshotTTL == 0 || time.Since(d.resolvedAt) < cli.SnapshotTTL) {
+		return d.repo, nil
+	}
+
+	r, err := lookupRepo(ctx, d.owner, d.name)
+	if err != nil {
+		return nil, err
+	}
+
+	d.replace(r)
+	return r, nil
+}
+
+// refresh replaces the snapshot of d's repository with a new one. If a new
+// snapshot can't be taken, the current one is kept.
+func (d *RepoDir) refresh(ctx context.Context) error {
+	owner, name, ok := d.ownerAndName()
+	if !ok {
+		return syscall.ENOENT
+	}
+
+	r, err := lookupRepo(ctx, owner, name)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// The repository may have been renamed in the meantime
+	if d.gone || d.name != name {
+		return nil
+	}
+	d.replace(r)
+	return nil
+}
+
+// ownerAndName returns the current owner and name of d's repository, and
+// whether it still exists.
+func (d *RepoDir) ownerAndName() (owner, name string, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.owner, d.name, !d.gone
+}
+
+// replace makes r the snapshot of d's repository. d.mu must be held. If the
+// default branch has moved since the previous snapshot, the entries the kernel
+// has cached within d are invalidated, since they belong to the previous
+// commit.
+func (d *RepoDir) replace(r *Repo) {
+	old := d.repo
+	d.repo, d.resolvedAt = r, time.Now()
+
+	if old != nil && old.root().Rev != r.root().Rev {
+		// The kernel may be waiting for the request that replaced the
+		// snapshot while holding locks that invalidation requires, so this
+		// can't happen synchronously
+		go d.invalidate(old)
+	}
+}
+
+// invalidate tells the kernel to forget d's attributes and listing, and the
+// entries within it that belonged to the snapshot old.
+func (d *RepoDir) invalidate(old *Repo) {
+	if srv == nil {
+		return
+	}
+
+	root := old.root()
+	entries, ok := listings.get(pathKey{old.Owner.Login, old.Name, root.Rev, ""})
+	if !ok {
+		objects.getJSON(treesKind, root.Oid, &entries)
+	}
+
+	names := []string{refsDirName, commitsDirName}
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+
+	for _, name := range names {
+		invalidateEntry(d, name)
+	}
+
+	err := srv.InvalidateNodeData(d)
+	if err != nil && !errors.Is(err, fuse.ErrNotCached) {
+		log.Println(err)
+	}
+}
+
+// invalidateEntry tells the kernel to forget the entry with the given name
+// within parent, if it has one cached.
+func invalidateEntry(parent fs.Node, name string) {
+	if srv == nil {
+		return
+	}
+
+	err := srv.InvalidateEntry(parent, name)
+	if err != nil && !errors.Is(err, fuse.ErrNotCached) {
+		log.Println(err)
+	}
+}
+
+func (d *RepoDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	r, err := d.snapshot(ctx)
+	if err != nil {
+		return err
+	}
+
+	a.Valid = cli.RepoTTL
+	a.Inode = inode(r.Id)
+	// RepoDir can be read but not written
+	setMode(a, os.ModeDir|0o500)
+	a.Mtime = r.PushedAt
+	a.Ctime = r.UpdatedAt
+
+	// TODO: set other equivalent information
+
+	return nil
+}
+
+func (d *RepoDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	resp.EntryValid = cli.RepoTTL
+	if req.Name == refreshFileName {
+		return &RefreshFile{dir: d}, nil
+	}
+
+	r, err := d.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	switch req.Name {
+	case refsDirName:
+		return &Refs{repo: r}, nil
+	case commitsDirName:
+		return &Commits{repo: r}, nil
+	case issuesDirName:
+		return &Issues{repo: r}, nil
+	}
+
+	n, err := r.root().Lookup(ctx, req, resp)
+	// Unlike those within other directories, the entries within RepoDir
+	// change whenever its snapshot is replaced
+	resp.EntryValid = cli.RepoTTL
+	return n, err
+}
+
+// RepoDir conceptually contains the default branch of the repository, as well
+// as hidden directories that allow browsing other refs, commits, and issues,
+// and the .refresh file. Those aren't displayed though, so that recursive tools
+// don't traverse every branch, tag, and issue, or try to read the .refresh
+// file, but they can still be accessed via lookup.
+func (d *RepoDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	r, err := d.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	root := r.root()
+	if cli.Prefetch {
+		d.mu.Lock()
+		first := d.prefetched != root.Rev
+		d.prefetched = root.Rev
+		d.mu.Unlock()
+
+		// If the prefetch is interrupted, the next listing tries again
+		if first && prefetchTree(ctx, root) != nil {
+			d.mu.Lock()
+			if d.prefetched == root.Rev {
+				d.prefetched = ""
+			}
+			d.mu.Unlock()
+		}
+	}
+
+	return root.ReadDirAll(ctx)
+}
+
+// RefreshFile implements fs.Node and fs.HandleWriter for the .refresh file of
+// a repository. Writing anything to it replaces the repository's snapshot, so
+// that subsequent lookups see the latest commit of its default branch.
+type RefreshFile struct {
+	// dir is the directory of the repository to refresh.
+	dir *RepoDir
+}
+
+func (f *RefreshFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Valid = cli.RepoTTL
+	// RefreshFile can be written but not read
+	setMode(a, 0o200)
+	return nil
+}
+
+func (f *RefreshFile) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if err := f.dir.refresh(ctx); err != nil {
+		return err
+	}
+
+	resp.Size = len(req.Data)
+	return nil
+}
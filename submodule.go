@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	graphql "github.com/cli/shurcooL-graphql"
+)
+
+// submodules returns the urls of the submodules of the repository that d
+// belongs to, at the revision d is being viewed at, keyed by their paths.
+func (d *Dir) submodules(ctx context.Context) (map[string]string, error) {
+	var query struct {
+		Repository struct {
+			Object struct {
+				Blob struct {
+					Text string
+				} `graphql:"... on Blob"`
+			} `graphql:"object(expression: $expression)"`
+		} `graphql:"repository(name: $name, owner: $owner)"`
+	}
+	err := runQuery(ctx, "GetGitmodules", &query, map[string]interface{}{
+		"name":       graphql.String(d.repo.Name),
+		"owner":      graphql.String(d.repo.Owner.Login),
+		"expression": graphql.String(d.Rev + ":.gitmodules"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return parseGitmodules(query.Repository.Object.Blob.Text), nil
+}
+
+// parseGitmodules parses the contents of a .gitmodules file, returning the
+// urls of the submodules it contains keyed by their paths.
+func parseGitmodules(text string) map[string]string {
+	type submodule struct{ path, url string }
+	var submodules []*submodule
+
+	var current *submodule
+	s := bufio.NewScanner(strings.NewReader(text))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' {
+			current = nil
+			if strings.HasPrefix(line, "[submodule") {
+				current = &submodule{}
+				submodules = append(submodules, current)
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if current == nil || !ok {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "path":
+			current.path = value
+		case "url":
+			current.url = value
+		}
+	}
+
+	m := make(map[string]string, len(submodules))
+	for _, sm := range submodules {
+		m[path.Clean(sm.path)] = sm.url
+	}
+	return m
+}
+
+// parseGitHubURL returns the owner and name of the github repository that
+// rawURL, the url of a submodule of super, refers to. If rawURL doesn't refer
+// to a github repository, ok is false.
+func parseGitHubURL(rawURL string, super *Repo) (owner, name string, ok bool) {
+	var p string
+	switch {
+	case rawURL == "":
+		return "", "", false
+	case strings.HasPrefix(rawURL, "./") || strings.HasPrefix(rawURL, "../"):
+		// Relative urls are relative to the superproject's url
+		p = path.Join(super.Owner.Login, super.Name, rawURL)
+	case strings.HasPrefix(rawURL, "git@github.com:"):
+		p = strings.TrimPrefix(rawURL, "git@github.com:")
+	default:
+		u, err := url.Parse(rawURL)
+		if err != nil || !strings.EqualFold(u.Hostname(), "github.com") {
+			return "", "", false
+		}
+		p = u.Path
+	}
+
+	owner, name, ok = strings.Cut(strings.Trim(path.Clean("/"+p), "/"), "/")
+	name = strings.TrimSuffix(name, ".git")
+	if !ok || owner == "" || name == "" || strings.Contains(name, "/") {
+		return "", "", false
+	}
+	return owner, name, true
+}
+
+// submoduleNode returns the node for a submodule with the given url, pinned at
+// the commit with the given oid, within super, where ino is the inode number
+// of its entry. Submodules hosted on github are
+// browsable directories, while others are files describing where they can be
+// found. Looking up submodules hosted on github whose repositories have been
+// deleted or are private fails instead, so that the submodules that can be
+// looked up are directories, as their directory entries say.
+func submoduleNode(ctx context.Context, rawURL, oid string, super *Repo, ino uint64) (fs.Node, error) {
+	if owner, name, ok := parseGitHubURL(rawURL, super); ok {
+		r, err := lookupRepo(ctx, owner, name)
+		if err != nil {
+			return nil, err
+		}
+		// Submodules are reached through the directory containing them
+		return &Dir{Path: "", Rev: oid, Via: strconv.FormatUint(ino, 16),
+			Inode: ino, repo: r}, nil
+	}
+
+	return &Submodule{URL: rawURL, Oid: oid, Inode: ino, repo: super}, nil
+}
+
+// Submodule implements fs.Node and fs.HandleReadAller for a submodule that
+// can't be browsed, because it isn't hosted on github. Its contents describe
+// where the submodule can be found.
+type Submodule struct {
+	// URL is the url of the submodule's repository.
+	URL string
+	// Oid is the commit that the submodule is pinned at.
+	Oid string
+	// Inode is the inode number of the submodule's entry.
+	Inode uint64
+	// Repo is the repository that contains this submodule.
+	repo *Repo
+}
+
+func (s *Submodule) contents() []byte {
+	return []byte(fmt.Sprintf("url = %s\ncommit = %s\n", s.URL, s.Oid))
+}
+
+func (s *Submodule) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Valid = cli.ObjectTTL
+	a.Inode = s.Inode
+	// Submodule can be read but not written
+	setMode(a, 0o400)
+	a.Size = uint64(len(s.contents()))
+	a.Mtime = s.repo.PushedAt
+	a.Ctime = s.repo.UpdatedAt
+
+	// TODO: set other equivalent information
+
+	return nil
+}
+
+func (s *Submodule) ReadAll(ctx context.Context) ([]byte, error) {
+	return s.contents(), nil
+}
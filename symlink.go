@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"bazil.org/fuse"
+	graphql "github.com/cli/shurcooL-graphql"
+)
+
+// danglingDirName is the name of a directory that never exists at the root of
+// a repository. Symlinks whose targets would escape the repository are
+// redirected into it, so they are left dangling instead of resolving to
+// somewhere in the user's real filesystem.
+const danglingDirName = ".gh-fs-dangling"
+
+// Symlink implements fs.Node and fs.NodeReadlinker for a symbolic link within
+// a repository.
+type Symlink struct {
+	// Path is the relative path to this symlink from the repository root.
+	Path string
+	// Rev is the id of the commit that this symlink is being viewed at.
+	Rev string
+	// Oid is the id of the blob containing this symlink's target.
+	Oid string
+	// Size is the length of this symlink's target.
+	Size int
+	// Repo is the repository that this symlink belongs to.
+	repo *Repo
+}
+
+func (l *Symlink) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Valid = cli.ObjectTTL
+	a.Inode = blobInode(l.repo, l.Path, l.Oid)
+	// Symlink permissions are never checked, so the conventional mode is used
+	setMode(a, os.ModeSymlink|0o777)
+	a.Size = uint64(l.Size)
+	t, ok := mtime(ctx, l.repo, l.Rev, l.Path)
+	if !ok {
+		// The actual time is fetched once the kernel asks again
+		a.Valid = cli.RepoTTL
+	}
+	a.Mtime = t
+	a.Ctime = l.repo.UpdatedAt
+
+	// TODO: set other equivalent information
+
+	return nil
+}
+
+func (l *Symlink) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	var query struct {
+		Repository struct {
+			Object struct {
+				Blob struct {
+					Text string
+				} `graphql:"... on Blob"`
+			} `graphql:"object(expression: $expression)"`
+		} `graphql:"repository(name: $name, owner: $owner)"`
+	}
+	err := runQuery(ctx, "GetSymlinkTarget", &query, map[string]interface{}{
+		"name":  graphql.String(l.repo.Name),
+		"owner": graphql.String(l.repo.Owner.Login),
+		"expression": graphql.String(fmt.Sprintf("%s:%s",
+			l.Rev, l.Path)),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return confineLink(l.Path, query.Repository.Object.Blob.Text), nil
+}
+
+// confineLink returns target, the target of the symlink at linkPath, if it
+// resolves within the repository. Otherwise, it returns a path within
+// danglingDirName, which will never resolve.
+//
+// Any component of target may itself be a symlink, in which case a following
+// ".." leaves wherever that symlink points rather than returning to where it
+// was. Such targets can't be checked without resolving every component, so
+// they're confined too.
+func confineLink(linkPath, target string) string {
+	dir := path.Dir(linkPath)
+	if !path.IsAbs(target) && !climbsAfterName(target) {
+		resolved := path.Join(dir, target)
+		if resolved != ".." && !strings.HasPrefix(resolved, "../") {
+			return target
+		}
+	}
+
+	depth := 0
+	if dir != "." {
+		depth = strings.Count(dir, "/") + 1
+	}
+	return strings.Repeat("../", depth) + danglingDirName + "/" +
+		strings.TrimPrefix(target, "/")
+}
+
+// climbsAfterName reports whether target contains a ".." component following
+// a named component.
+func climbsAfterName(target string) bool {
+	named := false
+	for _, c := range strings.Split(target, "/") {
+		switch c {
+		case "", ".":
+		case "..":
+			if named {
+				return true
+			}
+		default:
+			named = true
+		}
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestConfineLink(t *testing.T) {
+	tests := []struct {
+		linkPath, target, want string
+	}{
+		{"x", "y", "y"},
+		{"x", "./a/b", "./a/b"},
+		{"a/x", "../y", "../y"},
+		{"a/b/x", "../../y", "../../y"},
+		{"a/b/x", "..", ".."},
+		{"x", "..", ".gh-fs-dangling/.."},
+		{"x", "../y", ".gh-fs-dangling/../y"},
+		{"a/x", "../../y", "../.gh-fs-dangling/../../y"},
+		{"x", "/etc/passwd", ".gh-fs-dangling/etc/passwd"},
+		{"a/b/x", "/etc/passwd", "../../.gh-fs-dangling/etc/passwd"},
+		{"a/b/c/up", "../../..", "../../.."},
+		{"a/b/c/up", "../../../..", "../../../.gh-fs-dangling/../../../.."},
+		{"x", "a/b/c/up/../../../../etc/passwd",
+			".gh-fs-dangling/a/b/c/up/../../../../etc/passwd"},
+		{"x", "a/../y", ".gh-fs-dangling/a/../y"},
+		{"a/x", ".././../y", "../.gh-fs-dangling/.././../y"},
+		{"a/x", "./../y", "./../y"},
+	}
+	for _, tt := range tests {
+		if got := confineLink(tt.linkPath, tt.target); got != tt.want {
+			t.Errorf("confineLink(%q, %q) = %q, want %q",
+				tt.linkPath, tt.target, got, tt.want)
+		}
+	}
+}